@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var addonCmd = &cobra.Command{
+	Use:   "addon",
+	Short: "Create a systemd-stub addon file",
+	Long: `Create a systemd-stub addon file out of the addon stub.
+
+systemd-stub loads signed addons from the <uki>.extra.d/ directory next to the UKI, and from
+the loader/addons/ directory of the ESP for all UKIs. Addon files have to be named *.addon.efi.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// use our own viper instance, as the create command binds the same flag names in the global one
+		v := viper.New()
+		if err := v.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+
+		if v.GetBool("debug") {
+			h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+			slog.SetDefault(slog.New(h))
+		}
+
+		sbat, err := valueOrFile(v.GetString("sbat"))
+		if err != nil {
+			return err
+		}
+
+		builder := &uki.AddonBuilder{
+			Arch:          v.GetString("arch"),
+			AddonStubPath: v.GetString("addon-stub-path"),
+			Cmdline:       v.GetString("cmdline"),
+			DTBPath:       v.GetString("dtb"),
+			UCodePath:     v.GetString("ucode"),
+			InitrdPath:    v.GetString("initrd"),
+			SBAT:          sbat,
+			SBKey:         v.GetString("sb-key"),
+			SBCert:        v.GetString("sb-cert"),
+			OutAddonPath:  v.GetString("output"),
+			Reproducible:  v.GetBool("reproducible"),
+		}
+
+		return builder.Build()
+	},
+}
+
+func init() {
+	addonCmd.Flags().StringP("arch", "a", "", "Arch of the addon file (x86_64, ia32, aarch64, riscv64, loongarch64). Detected from the addon stub if not set.")
+	addonCmd.Flags().String("addon-stub-path", "", "Path to the addon stub. Defaults to the systemd one for the arch.")
+	addonCmd.Flags().StringP("cmdline", "c", "", "Kernel cmdline to append to the one of the UKI.")
+	addonCmd.Flags().String("dtb", "", "Path to the devicetree blob.")
+	addonCmd.Flags().String("ucode", "", "Path to the microcode cpio archive or raw Intel/AMD blob.")
+	addonCmd.Flags().StringP("initrd", "i", "", "Path to the initrd image.")
+	addonCmd.Flags().String("sbat", "", "SBAT entries to add to the ones of the addon stub, as TEXT or @PATH.")
+	addonCmd.Flags().String("sb-cert", "", "SecureBoot certificate to sign the addon with.")
+	addonCmd.Flags().String("sb-key", "", "SecureBoot key to sign the addon with.")
+	addonCmd.Flags().String("output", "addon.addon.efi", "addon artifact output, must end in .addon.efi to be loaded.")
+	addonCmd.Flags().Bool("reproducible", false, "Build a reproducible addon, using SOURCE_DATE_EPOCH (or 0) for its timestamps.")
+	addonCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	rootCmd.AddCommand(addonCmd)
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var initrdCmd = &cobra.Command{
+	Use:   "initrd DIR",
+	Short: "Create a cpio initrd out of a directory",
+	Long: `Create a reproducible newc cpio archive out of the files of a directory, to pass to
+ukify create with --initrd.
+
+Entries keep their permissions, but are owned by root and have a zero mtime.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// use our own viper instance, as the create command binds the same flag names in the global one
+		v := viper.New()
+		if err := v.BindPFlags(cmd.Flags()); err != nil {
+			return err
+		}
+
+		if v.GetBool("debug") {
+			h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+			slog.SetDefault(slog.New(h))
+		}
+
+		var archive bytes.Buffer
+
+		if err := initrd.BuildDir(&archive, args[0], initrd.Options{Gzip: v.GetBool("gzip")}); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(v.GetString("output"), archive.Bytes(), 0o644); err != nil {
+			return err
+		}
+
+		slog.Info("Initrd created", "path", v.GetString("output"))
+
+		return nil
+	},
+}
+
+func init() {
+	initrdCmd.Flags().StringP("output", "o", "initrd.cpio", "initrd artifact output.")
+	initrdCmd.Flags().Bool("gzip", false, "Compress the archive with gzip.")
+	initrdCmd.Flags().Bool("debug", false, "Enable debug output")
+
+	rootCmd.AddCommand(initrdCmd)
+}
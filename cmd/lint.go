@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+)
+
+var lintCmd = &cobra.Command{
+	Use:          "lint UKI...",
+	Short:        "Check the structure of uki files",
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		failed := false
+
+		for _, path := range args {
+			issues, err := uki.Lint(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+
+			for _, issue := range issues {
+				fmt.Printf("%s: %s\n", path, issue)
+
+				if issue.Severity == uki.LintError {
+					failed = true
+				}
+			}
+		}
+
+		if failed {
+			return errors.New("uki files have lint errors")
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+}
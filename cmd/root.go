@@ -1,8 +1,10 @@
 package cmd
 
 import (
-	"github.com/spf13/cobra"
 	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
 )
 
 func NewRootCmd() *cobra.Command {
@@ -26,3 +28,15 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+// valueOrFile returns the value of a flag accepting either TEXT or @PATH, reading the file for the latter.
+func valueOrFile(value string) (string, error) {
+	path, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return value, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	return string(data), err
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+	"github.com/kairos-io/go-ukify/pkg/uki"
+	"github.com/spf13/cobra"
+)
+
+var sbatCmd = &cobra.Command{
+	Use:   "sbat",
+	Short: "Inspect the SBAT metadata of EFI binaries",
+}
+
+var sbatCheckCmd = &cobra.Command{
+	Use:   "check --policy SBATLEVEL EFI...",
+	Short: "Check EFI binaries against an SbatLevel revocation policy",
+	Long: `Check whether shim would refuse the sd-stubs, sd-boot binaries or UKIs given, with the SbatLevel
+revocation policy given, e.g. one of the policies of shim's SbatLevel_Variable.txt:
+
+  sbat,1,2024010900
+  shim,4
+  grub,4`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		policy, err := cmd.Flags().GetString("policy")
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(policy)
+		if err != nil {
+			return err
+		}
+
+		level, err := sbat.ParseLevel(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", policy, err)
+		}
+
+		refused := false
+
+		for _, path := range args {
+			data, err := uki.GetSBAT(path)
+			if err != nil {
+				fmt.Printf("%s: refused, no SBAT: %s\n", path, err)
+				refused = true
+
+				continue
+			}
+
+			entries, err := sbat.Parse(data)
+			if err != nil {
+				fmt.Printf("%s: refused, invalid SBAT: %s\n", path, err)
+				refused = true
+
+				continue
+			}
+
+			violations := sbat.Check(entries, level)
+			if len(violations) == 0 {
+				fmt.Printf("%s: ok\n", path)
+
+				continue
+			}
+
+			for _, violation := range violations {
+				fmt.Printf("%s: refused, %s\n", path, violation)
+			}
+
+			refused = true
+		}
+
+		if refused {
+			return errors.New("shim would refuse some of the EFI binaries")
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	sbatCheckCmd.Flags().String("policy", "", "Path to the SbatLevel revocation policy.")
+	_ = sbatCheckCmd.MarkFlagRequired("policy")
+
+	sbatCmd.AddCommand(sbatCheckCmd)
+	rootCmd.AddCommand(sbatCmd)
+}
@@ -35,21 +35,91 @@ var createUkify = &cobra.Command{
 		}
 
 		builder := &uki.Builder{
-			Arch:          viper.GetString("arch"),
-			Version:       viper.GetString("version"),
-			SdStubPath:    viper.GetString("sd-stub-path"),
-			SdBootPath:    viper.GetString("sd-boot-path"),
-			KernelPath:    viper.GetString("kernel"),
-			InitrdPath:    viper.GetString("initrd"),
-			Cmdline:       viper.GetString("cmdline"),
-			OutSdBootPath: viper.GetString("output-sdboot"),
-			OutUKIPath:    viper.GetString("output-uki"),
-			PCRKey:        viper.GetString("pcr-key"),
-			SBKey:         viper.GetString("sb-key"),
-			SBCert:        viper.GetString("sb-cert"),
-			Splash:        viper.GetString("splash"),
-			Phases:        parsedPhases,
-			ExtraCmdlines: viper.GetStringSlice("extra-cmdline"),
+			Arch:                viper.GetString("arch"),
+			Version:             viper.GetString("version"),
+			ImageID:             viper.GetString("image-id"),
+			ImageVersion:        viper.GetString("image-version"),
+			BuildID:             viper.GetString("build-id"),
+			VariantID:           viper.GetString("variant-id"),
+			SysextLevel:         viper.GetString("sysext-level"),
+			SdStubPath:          viper.GetString("sd-stub-path"),
+			SdBootPath:          viper.GetString("sd-boot-path"),
+			KernelPath:          viper.GetString("kernel"),
+			Uname:               viper.GetString("uname"),
+			InitrdPaths:         viper.GetStringSlice("initrd"),
+			Microcode:           viper.GetStringSlice("microcode"),
+			Sysexts:             viper.GetStringSlice("sysext"),
+			Confexts:            viper.GetStringSlice("confext"),
+			DevicetreePath:      viper.GetString("devicetree"),
+			DevicetreeAutoPaths: viper.GetStringSlice("devicetree-auto"),
+			Cmdline:             viper.GetString("cmdline"),
+			OutSdBootPath:       viper.GetString("output-sdboot"),
+			OutUKIPath:          viper.GetString("output-uki"),
+			PCRKey:              viper.GetString("pcr-key"),
+			PCRs:                viper.GetIntSlice("pcrs"),
+			SBKey:               viper.GetString("sb-key"),
+			SBCert:              viper.GetString("sb-cert"),
+			Splash:              viper.GetString("splash"),
+			NoSplash:            viper.GetBool("no-splash"),
+			Phases:              parsedPhases,
+			ExtraCmdlines:       viper.GetStringSlice("extra-cmdline"),
+			Reproducible:        viper.GetBool("reproducible"),
+		}
+
+		for _, spec := range viper.GetStringSlice("section") {
+			section, err := uki.ParseSection(spec)
+			if err != nil {
+				return err
+			}
+			builder.ExtraSections = append(builder.ExtraSections, section)
+		}
+
+		for _, path := range viper.GetStringSlice("profile") {
+			profile, err := uki.LoadProfile(path)
+			if err != nil {
+				return err
+			}
+			builder.Profiles = append(builder.Profiles, profile)
+		}
+
+		for _, spec := range viper.GetStringSlice("pcr-value") {
+			value, err := uki.ParsePCRValue(spec)
+			if err != nil {
+				return err
+			}
+			builder.PCRValues = append(builder.PCRValues, value)
+		}
+
+		for _, spec := range viper.GetStringSlice("credential") {
+			credential, err := uki.ParseCredential(spec)
+			if err != nil {
+				return err
+			}
+			builder.Credentials = append(builder.Credentials, credential)
+		}
+
+		for _, value := range viper.GetStringSlice("sbat") {
+			sbat, err := valueOrFile(value)
+			if err != nil {
+				return err
+			}
+			builder.SBAT += strings.TrimSuffix(sbat, "\n") + "\n"
+		}
+
+		if path, ok := strings.CutPrefix(builder.Cmdline, "@"); ok {
+			cmdline, err := uki.ReadCmdline(path)
+			if err != nil {
+				return err
+			}
+			builder.Cmdline = cmdline
+		}
+
+		if viper.GetString("hwids") != "" {
+			hwids, err := uki.LoadHWIDs(viper.GetString("hwids"))
+			if err != nil {
+				return err
+			}
+			builder.HWIDs = hwids
 		}
 
 		if viper.GetString("os-release") != "" {
@@ -61,27 +131,47 @@ var createUkify = &cobra.Command{
 }
 
 func init() {
-	createUkify.Flags().StringP("arch", "a", "", "Arch of the UKI file.")
+	createUkify.Flags().StringP("arch", "a", "", "Arch of the UKI file (x86_64, ia32, aarch64, riscv64, loongarch64). Detected from the sd-stub if not set.")
 	createUkify.Flags().String("version", "", "Version.")
-	createUkify.Flags().StringP("sd-stub-path", "s", "", "Path to the sd-stub.")
+	createUkify.Flags().StringP("sd-stub-path", "s", "", "Path to the sd-stub. Defaults to the systemd one for the arch.")
 	createUkify.Flags().StringP("sd-boot-path", "b", "", "Path to the sd-boot.")
 	createUkify.Flags().StringP("kernel", "k", "", "Path to the kernel image.")
-	createUkify.Flags().StringP("initrd", "i", "", "Path to the initrd image.")
-	createUkify.Flags().StringP("cmdline", "c", "", "Kernel cmdline.")
-	createUkify.Flags().StringP("os-release", "o", "", "os-release file.")
+	createUkify.Flags().String("uname", "", "Kernel version for the .uname section. Discovered from the kernel or the initrd if not set.")
+	createUkify.Flags().StringArrayP("initrd", "i", []string{}, "Path to an initrd image, concatenated in order with the other ones (repeatable)")
+	createUkify.Flags().StringArray("credential", []string{}, "Credential to embed in the initrd as NAME=PATH (repeatable)")
+	createUkify.Flags().StringArray("sysext", []string{}, "Path to a .sysext.raw image to embed in the initrd (repeatable)")
+	createUkify.Flags().StringArray("confext", []string{}, "Path to a .confext.raw image to embed in the initrd (repeatable)")
+	createUkify.Flags().StringArray("microcode", []string{}, "Path to a microcode cpio archive or raw Intel/AMD blob (repeatable)")
+	createUkify.Flags().String("devicetree", "", "Path to the devicetree blob to embed.")
+	createUkify.Flags().StringArray("devicetree-auto", []string{}, "Path to a devicetree blob for systemd-stub to pick from, in order of preference (repeatable)")
+	createUkify.Flags().String("hwids", "", "Directory of hwids description files (*.json), mapping hardware IDs to the --devicetree-auto compatibles.")
+	createUkify.Flags().StringP("cmdline", "c", "", "Kernel cmdline, or @PATH to read it from a file like /etc/kernel/cmdline. Can use os-release fields as {{ .OSRelease.VERSION_ID }}, and {{ .Version }} and {{ .Arch }}.")
+	createUkify.Flags().StringP("os-release", "o", "", "os-release file. Generated if not set, the os-release fields given are merged into it otherwise.")
+	createUkify.Flags().String("image-id", "", "IMAGE_ID of the os-release.")
+	createUkify.Flags().String("image-version", "", "IMAGE_VERSION of the os-release.")
+	createUkify.Flags().String("build-id", "", "BUILD_ID of the os-release.")
+	createUkify.Flags().String("variant-id", "", "VARIANT_ID of the os-release.")
+	createUkify.Flags().String("sysext-level", "", "SYSEXT_LEVEL of the os-release.")
 	createUkify.Flags().String("sb-cert", "", "SecureBoot certificate to sign efi files with.")
 	createUkify.Flags().String("sb-key", "", "SecureBoot certificate to sign efi files with.")
 	createUkify.Flags().StringP("pcr-key", "p", "", "PCR key.")
+	createUkify.Flags().IntSlice("pcrs", []int{}, "PCRs bound by the signed PCR policies, including 11 which the UKI is measured to. Defaults to 11 alone.")
+	createUkify.Flags().StringArray("pcr-value", []string{}, "Expected value of one of the other --pcrs as PCR:BANK=HEX, e.g. 7:sha256=<digest> for the Secure Boot state (repeatable)")
 	createUkify.Flags().StringP("output-sdboot", "", "sdboot.signed.efi", "sdboot output.")
 	createUkify.Flags().StringP("output-uki", "", "uki.signed.efi", "uki artifact output.")
 	createUkify.Flags().StringP("phases", "", "enter-initrd:leave-initrd:sysinit:ready", "phases to measure for, separated by : and in order of measurement")
-	createUkify.Flags().String("splash", "", "Path to the custom logo splash BMP file.")
+	createUkify.Flags().String("splash", "", "Path to the custom logo splash BMP, PNG or JPEG file.")
+	createUkify.Flags().StringArray("sbat", []string{}, "SBAT entries to add to the ones of the sd-stub, as TEXT or @PATH (repeatable)")
+	createUkify.Flags().Bool("no-splash", false, "Do not add a splash to the UKI.")
 	createUkify.Flags().Bool("debug", false, "Enable debug output")
+	createUkify.Flags().Bool("reproducible", false, "Build a reproducible UKI, using SOURCE_DATE_EPOCH (or 0) for its timestamps.")
 	createUkify.Flags().StringSlice("extra-cmdline", []string{}, "Additional profile cmdlines (repeatable)")
+	createUkify.Flags().StringArray("profile", []string{}, "Path to a JSON profile description, making a multi-profile UKI with a profile for each (repeatable)")
+	createUkify.Flags().StringArray("section", []string{}, "Additional section as NAME:PATH[:measure] (repeatable)")
 
-	_ = createUkify.MarkFlagRequired("sd-stub-path")
 	_ = createUkify.MarkFlagRequired("initrd")
 	_ = createUkify.MarkFlagRequired("kernel")
+	createUkify.MarkFlagsMutuallyExclusive("splash", "no-splash")
 	_ = viper.BindPFlags(createUkify.Flags())
 
 	rootCmd.AddCommand(createUkify)
@@ -10,7 +10,7 @@ import (
 func main() {
 	// Allow catching SIGINT to exit soon
 	go func() {
-		sigchan := make(chan os.Signal)
+		sigchan := make(chan os.Signal, 1)
 		signal.Notify(sigchan, os.Interrupt)
 		<-sigchan
 		log.Println("Program killed !")
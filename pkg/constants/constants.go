@@ -21,8 +21,9 @@ const (
 ID={{ .ID }}
 VERSION_ID={{ .Version }}
 PRETTY_NAME="{{ .Name }} ({{ .Version }})"
-)
 `
+	// AddonSBAT is the SBAT entry added to the one of the addon stub when building addons.
+	AddonSBAT = "uki-addon,1,UKI Addon,addon,1,https://www.freedesktop.org/software/systemd/man/latest/systemd-stub.html\n"
 	// EnterInitrd is the phase value extended to the PCR during the initrd.
 	EnterInitrd Phase = "enter-initrd"
 	LeaveInitrd Phase = "leave-initrd"
@@ -43,12 +44,16 @@ PRETTY_NAME="{{ .Name }} ({{ .Version }})"
 	PCRSig  Section = ".pcrsig"
 	PCRPKey Section = ".pcrpkey"
 	Profile Section = ".profile"
+	UCode   Section = ".ucode"
+	DTBAuto Section = ".dtbauto"
+	HWIDs   Section = ".hwids"
 )
 
 // OrderedSections returns the sections that are measured into PCR.
 //
 // Derived from https://github.com/systemd/systemd/blob/main/src/fundamental/tpm-pcr.h#L23-L36
 // .pcrsig section is omitted here since that's what we are calulating here.
+// Only the .profile section of the profile systemd-stub boots is measured, see uki.Profile.
 func OrderedSections() []Section {
 	// DO NOT REARRANGE
 	return []Section{
@@ -56,11 +61,37 @@ func OrderedSections() []Section {
 		OSRel,
 		CMDLine,
 		Initrd,
+		UCode,
+		Splash,
+		DTB,
+		Uname,
+		SBAT,
+		PCRPKey,
+		Profile,
+		DTBAuto,
+		HWIDs}
+}
+
+// UKISections returns all the sections systemd-stub knows about in a UKI.
+//
+// Derived from https://github.com/systemd/systemd/blob/main/src/fundamental/uki.h
+func UKISections() []Section {
+	return []Section{
+		Linux,
+		OSRel,
+		CMDLine,
+		Initrd,
+		UCode,
 		Splash,
 		DTB,
 		Uname,
 		SBAT,
-		PCRPKey}
+		PCRSig,
+		PCRPKey,
+		Profile,
+		DTBAuto,
+		HWIDs,
+	}
 }
 
 // OSReleaseFor returns the contents of /etc/os-release for a given name and version.
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package initrd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+// Options of the archives built by Build.
+type Options struct {
+	// Gzip compresses the archive, which the kernel unpacks as well.
+	Gzip bool
+}
+
+// Build writes a newc cpio archive of the files, directories and symbolic links of fsys to w.
+//
+// Entries are written in lexical order with their permissions, but owned by root and with a zero
+// mtime, so that the same tree always produces the same archive. The result can be used as is as
+// the initrd of the UKI Builder, e.g. through its Initrd reader.
+func Build(w io.Writer, fsys fs.FS, opts Options) error {
+	if opts.Gzip {
+		zw := gzip.NewWriter(w)
+
+		if err := build(zw, fsys); err != nil {
+			return err
+		}
+
+		return zw.Close()
+	}
+
+	return build(w, fsys)
+}
+
+// BuildDir writes a newc cpio archive of the directory tree at dir to w, see Build.
+func BuildDir(w io.Writer, dir string, opts Options) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+
+	return Build(w, os.DirFS(dir), opts)
+}
+
+func build(w io.Writer, fsys fs.FS) error {
+	cw := NewWriter(w)
+
+	err := fs.WalkDir(fsys, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		slog.Debug("Adding to initrd", "path", path, "mode", info.Mode())
+
+		switch info.Mode().Type() {
+		case fs.ModeDir:
+			return cw.AddDir(path, info.Mode())
+		case fs.ModeSymlink:
+			target, err := fs.ReadLink(fsys, path)
+			if err != nil {
+				return err
+			}
+
+			return cw.AddSymlink(path, target)
+		case 0:
+			data, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				return err
+			}
+
+			return cw.AddFile(path, info.Mode(), data)
+		default:
+			return fmt.Errorf("%s: unsupported file type %s", path, info.Mode().Type())
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return cw.Close()
+}
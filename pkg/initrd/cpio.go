@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package initrd writes the cpio archives the kernel unpacks as initrds.
+package initrd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+)
+
+// newc format, based on https://docs.kernel.org/driver-api/early-userspace/buffer-format.html.
+const (
+	cpioMagic      = "070701"
+	cpioHeaderSize = 110
+	cpioTrailer    = "TRAILER!!!"
+)
+
+// Mode bits of the cpio entries, as in stat(2).
+const (
+	modeDir     = 0o040000
+	modeFile    = 0o100000
+	modeSymlink = 0o120000
+)
+
+// IsCPIO reports whether data starts with a newc cpio archive, with or without checksums.
+func IsCPIO(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(cpioMagic)) || bytes.HasPrefix(data, []byte("070702"))
+}
+
+// Writer writes a newc cpio archive.
+//
+// All entries are owned by root and have a zero mtime, so that the same entries always produce
+// the same archive.
+type Writer struct {
+	w       io.Writer
+	written int64
+	ino     uint32
+}
+
+// NewWriter creates a cpio archive writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// AddDir adds a directory entry.
+func (cw *Writer) AddDir(name string, perm fs.FileMode) error {
+	return cw.writeEntry(name, modeDir|uint32(perm.Perm()), 2, nil)
+}
+
+// AddFile adds a regular file entry. newc archives cannot hold files larger than 4 GiB.
+func (cw *Writer) AddFile(name string, perm fs.FileMode, data []byte) error {
+	return cw.writeEntry(name, modeFile|uint32(perm.Perm()), 1, data)
+}
+
+// AddSymlink adds a symbolic link entry, pointing to target.
+func (cw *Writer) AddSymlink(name, target string) error {
+	return cw.writeEntry(name, modeSymlink|0o777, 1, []byte(target))
+}
+
+// Close writes the trailer of the archive. It does not close the underlying writer.
+func (cw *Writer) Close() error {
+	return cw.writeEntry(cpioTrailer, 0, 1, nil)
+}
+
+func (cw *Writer) writeEntry(name string, mode, nlink uint32, data []byte) error {
+	// the header stores the size in 8 hex digits
+	if uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("%s is %d bytes long, larger than a cpio archive can hold", name, len(data))
+	}
+
+	ino := uint32(0)
+	if name != cpioTrailer {
+		cw.ino++
+		ino = cw.ino
+	}
+
+	// ino, mode, uid, gid, nlink, mtime, filesize, devmajor, devminor, rdevmajor, rdevminor, namesize and check
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioMagic, ino, mode, 0, 0, nlink, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+
+	if err := cw.write([]byte(header)); err != nil {
+		return err
+	}
+
+	if err := cw.write(append([]byte(name), 0)); err != nil {
+		return err
+	}
+
+	if err := cw.pad(); err != nil {
+		return err
+	}
+
+	if err := cw.write(data); err != nil {
+		return err
+	}
+
+	return cw.pad()
+}
+
+func (cw *Writer) write(data []byte) error {
+	n, err := cw.w.Write(data)
+	cw.written += int64(n)
+
+	return err
+}
+
+// pad aligns the archive to 4 bytes, as both the names and the contents of the entries are.
+func (cw *Writer) pad() error {
+	return cw.write(make([]byte, (4-cw.written%4)%4))
+}
@@ -0,0 +1,200 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"math"
+	"strconv"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Initrd test Suite")
+}
+
+// cpioEntry is an entry read back from a newc archive.
+type cpioEntry struct {
+	name string
+	mode uint32
+	data []byte
+}
+
+// readCPIO parses a newc archive up to its trailer.
+func readCPIO(archive []byte) []cpioEntry {
+	var entries []cpioEntry
+
+	offset := 0
+
+	for {
+		Expect(len(archive)).To(BeNumerically(">=", offset+cpioHeaderSize))
+		Expect(string(archive[offset : offset+6])).To(Equal(cpioMagic))
+
+		field := func(i int) uint32 {
+			v, err := strconv.ParseUint(string(archive[offset+6+8*i:offset+14+8*i]), 16, 32)
+			Expect(err).ToNot(HaveOccurred())
+
+			return uint32(v)
+		}
+
+		mode, fileSize, nameSize := field(1), int(field(6)), int(field(11))
+
+		name := string(archive[offset+cpioHeaderSize : offset+cpioHeaderSize+nameSize-1])
+		offset = (offset + cpioHeaderSize + nameSize + 3) &^ 3
+		data := archive[offset : offset+fileSize]
+		offset = (offset + fileSize + 3) &^ 3
+
+		if name == cpioTrailer {
+			Expect(offset).To(Equal(len(archive)))
+
+			return entries
+		}
+
+		entries = append(entries, cpioEntry{name: name, mode: mode, data: data})
+	}
+}
+
+var _ = Describe("Initrd tests", func() {
+	Describe("Writer", func() {
+		It("Writes a newc archive", func() {
+			var archive bytes.Buffer
+
+			w := NewWriter(&archive)
+			Expect(w.AddDir("kernel", 0o755)).To(Succeed())
+			Expect(w.AddFile("kernel/blob.bin", 0o644, []byte("hello"))).To(Succeed())
+			Expect(w.Close()).To(Succeed())
+
+			Expect(IsCPIO(archive.Bytes())).To(BeTrue())
+			Expect(archive.Len() % 4).To(BeZero())
+			Expect(readCPIO(archive.Bytes())).To(Equal([]cpioEntry{
+				{name: "kernel", mode: 0o040755, data: []byte{}},
+				{name: "kernel/blob.bin", mode: 0o100644, data: []byte("hello")},
+			}))
+		})
+
+		It("Rejects files larger than 4 GiB", func() {
+			if strconv.IntSize == 32 {
+				Skip("slices cannot be larger than 4 GiB")
+			}
+
+			var archive bytes.Buffer
+
+			// the pages are never touched, as the size is checked first
+			size := uint64(math.MaxUint32) + 1
+			Expect(NewWriter(&archive).AddFile("huge.raw", 0o644, make([]byte, size))).
+				To(MatchError("huge.raw is 4294967296 bytes long, larger than a cpio archive can hold"))
+			Expect(archive.Len()).To(BeZero())
+		})
+
+		It("Writes the same archive for the same entries", func() {
+			build := func() []byte {
+				var archive bytes.Buffer
+
+				w := NewWriter(&archive)
+				Expect(w.AddFile("init", 0o755, []byte("#!/bin/sh\n"))).To(Succeed())
+				Expect(w.Close()).To(Succeed())
+
+				return archive.Bytes()
+			}
+
+			Expect(build()).To(Equal(build()))
+		})
+	})
+
+	Describe("Build", func() {
+		fsys := fstest.MapFS{
+			"etc/kairos/config.yaml": {Data: []byte("#cloud-config\n"), Mode: 0o600},
+			"lib/firmware":           {Mode: fs.ModeDir | 0o700},
+			"lib/etc":                {Data: []byte("../etc"), Mode: fs.ModeSymlink | 0o777},
+		}
+
+		expected := []cpioEntry{
+			{name: "etc", mode: 0o040555, data: []byte{}},
+			{name: "etc/kairos", mode: 0o040555, data: []byte{}},
+			{name: "etc/kairos/config.yaml", mode: 0o100600, data: []byte("#cloud-config\n")},
+			{name: "lib", mode: 0o040555, data: []byte{}},
+			{name: "lib/etc", mode: 0o120777, data: []byte("../etc")},
+			{name: "lib/firmware", mode: 0o040700, data: []byte{}},
+		}
+
+		It("Archives a file system in lexical order", func() {
+			var archive bytes.Buffer
+
+			Expect(Build(&archive, fsys, Options{})).To(Succeed())
+			Expect(readCPIO(archive.Bytes())).To(Equal(expected))
+		})
+
+		It("Compresses the archive with gzip", func() {
+			var archive, compressed bytes.Buffer
+
+			Expect(Build(&archive, fsys, Options{})).To(Succeed())
+			Expect(Build(&compressed, fsys, Options{Gzip: true})).To(Succeed())
+
+			r, err := gzip.NewReader(&compressed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Header.ModTime.IsZero()).To(BeTrue())
+
+			data, err := io.ReadAll(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal(archive.Bytes()))
+		})
+
+		It("Rejects special files", func() {
+			Expect(Build(io.Discard, fstest.MapFS{"dev/null": {Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666}}, Options{})).
+				To(MatchError(ContainSubstring("dev/null: unsupported file type")))
+		})
+	})
+
+	Describe("List", func() {
+		It("Lists the entries of concatenated and compressed archives", func() {
+			var early, main bytes.Buffer
+
+			Expect(Build(&early, fstest.MapFS{"kernel/x86/microcode/GenuineIntel.bin": {Data: []byte("ucode")}}, Options{})).To(Succeed())
+			Expect(Build(&main, fstest.MapFS{"init": {Data: []byte("#!/bin/sh\n"), Mode: 0o755}}, Options{Gzip: true})).To(Succeed())
+
+			initrd := append(early.Bytes(), make([]byte, 512)...)
+			initrd = append(initrd, main.Bytes()...)
+			initrd = append(initrd, early.Bytes()...)
+
+			names, err := List(initrd)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(names).To(Equal([]string{
+				"kernel", "kernel/x86", "kernel/x86/microcode", "kernel/x86/microcode/GenuineIntel.bin",
+				"init",
+				"kernel", "kernel/x86", "kernel/x86/microcode", "kernel/x86/microcode/GenuineIntel.bin",
+			}))
+		})
+
+		It("Reads the modes of the entries", func() {
+			var archive bytes.Buffer
+
+			w := NewWriter(&archive)
+			Expect(w.AddDir("etc", 0o755)).To(Succeed())
+			Expect(w.AddFile("etc/shadow", 0o400, []byte("root:*"))).To(Succeed())
+			Expect(w.AddSymlink("etc/mtab", "../proc/self/mounts")).To(Succeed())
+			Expect(w.Close()).To(Succeed())
+
+			files, err := Files(archive.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(Equal([]File{
+				{Name: "etc", Mode: fs.ModeDir | 0o755},
+				{Name: "etc/shadow", Mode: 0o400},
+				{Name: "etc/mtab", Mode: fs.ModeSymlink | 0o777},
+			}))
+		})
+
+		It("Rejects what is not an initrd", func() {
+			_, err := List([]byte("initrd"))
+			Expect(err).To(HaveOccurred())
+
+			_, err = List([]byte(cpioMagic + "truncated"))
+			Expect(err).To(MatchError(ContainSubstring("truncated")))
+		})
+	})
+})
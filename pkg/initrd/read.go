@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression magics of the initrd segments, as recognized by the kernel.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// File is an entry of an initrd: a regular file, a directory or a symbolic link.
+type File struct {
+	Name string
+	// Mode has the permissions of the entry, and fs.ModeDir or fs.ModeSymlink for directories
+	// and symbolic links.
+	Mode fs.FileMode
+}
+
+// List returns the names of the entries of an initrd, see Files.
+func List(data []byte) ([]string, error) {
+	files, err := Files(data)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+
+	return names, nil
+}
+
+// Files returns the entries of an initrd, which can be made of several concatenated cpio
+// archives, uncompressed or compressed with gzip or zstd, as the kernel unpacks them.
+func Files(data []byte) ([]File, error) {
+	var entries []File
+
+	for len(data) > 0 {
+		switch {
+		case data[0] == 0:
+			// archives are padded with NULs
+			data = data[1:]
+		case IsCPIO(data):
+			archiveEntries, size, err := cpioEntries(data)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, archiveEntries...)
+			data = data[size:]
+		case bytes.HasPrefix(data, gzipMagic):
+			r := bytes.NewReader(data)
+
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+
+			// stop at the end of the gzip stream, which is followed by the next segment
+			zr.Multistream(false)
+
+			decompressed, err := io.ReadAll(zr)
+			if err != nil {
+				return nil, fmt.Errorf("error decompressing initrd: %w", err)
+			}
+
+			segmentEntries, err := Files(decompressed)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, segmentEntries...)
+			data = data[len(data)-r.Len():]
+		case bytes.HasPrefix(data, zstdMagic):
+			zr, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+
+			// zstd frames are only ever the last segment in practice
+			decompressed, err := zr.DecodeAll(data, nil)
+			zr.Close()
+
+			if err != nil {
+				return nil, fmt.Errorf("error decompressing initrd: %w", err)
+			}
+
+			segmentEntries, err := Files(decompressed)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(entries, segmentEntries...), nil
+		default:
+			return nil, errors.New("initrd segment is neither a cpio archive, nor gzip or zstd compressed")
+		}
+	}
+
+	return entries, nil
+}
+
+// cpioEntries returns the entries of the newc archive at the start of data, and the size of the archive.
+func cpioEntries(data []byte) ([]File, int, error) {
+	var entries []File
+
+	offset := 0
+
+	for {
+		if offset+cpioHeaderSize > len(data) {
+			return nil, 0, errors.New("cpio archive is truncated")
+		}
+
+		field := func(i int) (int, error) {
+			v, err := strconv.ParseUint(string(data[offset+6+8*i:offset+14+8*i]), 16, 32)
+			if err != nil {
+				return 0, fmt.Errorf("cpio archive has an invalid header: %w", err)
+			}
+
+			return int(v), nil
+		}
+
+		mode, err := field(1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		fileSize, err := field(6)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		nameSize, err := field(11)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		nameEnd := offset + cpioHeaderSize + nameSize
+		dataStart := (nameEnd + 3) &^ 3
+		dataEnd := (dataStart + fileSize + 3) &^ 3
+
+		if nameSize == 0 || dataStart+fileSize > len(data) {
+			return nil, 0, errors.New("cpio archive is truncated")
+		}
+
+		name := string(data[offset+cpioHeaderSize : nameEnd-1])
+		offset = min(dataEnd, len(data))
+
+		if name == cpioTrailer {
+			return entries, offset, nil
+		}
+
+		entry := File{Name: name, Mode: fs.FileMode(mode).Perm()}
+
+		switch mode &^ 0o7777 {
+		case modeDir:
+			entry.Mode |= fs.ModeDir
+		case modeSymlink:
+			entry.Mode |= fs.ModeSymlink
+		}
+
+		entries = append(entries, entry)
+	}
+}
@@ -9,11 +9,13 @@ package measure
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/measure/pcr"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"log/slog"
+	"os"
 	"os/exec"
 	"regexp"
 )
@@ -21,41 +23,100 @@ import (
 // SectionsData holds a map of Section to file path to the corresponding section.
 type SectionsData map[constants.Section]string
 
+// SectionsContent holds a map of Section to the contents of the corresponding section.
+type SectionsContent map[constants.Section][]byte
+
 // GenerateSignedPCR generates the PCR signed data for a given set of UKI file sections.
 func GenerateSignedPCR(sectionsData SectionsData, phases []types.PhaseInfo, rsaKey types.RSAKey, PCR int) (*types.PCRData, error) {
-	data := &types.PCRData{}
-	slog.Debug("Generating PCR data", "sections", sectionsData)
+	sectionsContent, err := readSections(sectionsData)
+	if err != nil {
+		return nil, err
+	}
+
+	return GenerateSignedPCRForContent(sectionsContent, phases, rsaKey, PCR)
+}
+
+// GenerateSignedPCRForContent generates the PCR signed data for the given contents of the UKI file sections.
+func GenerateSignedPCRForContent(sectionsContent SectionsContent, phases []types.PhaseInfo, rsaKey types.RSAKey, PCR int) (*types.PCRData, error) {
+	return GenerateSignedPolicyForContent(sectionsContent, phases, rsaKey, PCR, nil)
+}
+
+// GenerateSignedPolicyForContent is like GenerateSignedPCRForContent, with policies binding the
+// other PCRs to the given values too. Only the banks all of these PCRs have a value for are signed.
+func GenerateSignedPolicyForContent(sectionsContent SectionsContent, phases []types.PhaseInfo, rsaKey types.RSAKey, PCR int, pcrValues []types.PCRValue) (*types.PCRData, error) {
+	slog.Debug("Generating PCR data", "sections", sectionNames(sectionsContent))
+
+	pcrs := map[int]bool{}
+	for _, value := range pcrValues {
+		if value.PCR == PCR {
+			return nil, fmt.Errorf("the value of PCR %d is measured from the sections, it cannot be given", PCR)
+		}
+
+		pcrs[value.PCR] = true
+	}
+
+	signed := false
 
 	data, algos := types.GetTPMALGorithm()
 	for _, alg := range algos {
+		values := map[int][]byte{}
+		for _, value := range pcrValues {
+			if value.Alg == alg.Alg {
+				values[value.PCR] = value.Value
+			}
+		}
+
+		if len(values) != len(pcrs) {
+			slog.Debug("Not signing bank without the values of all the PCRs", "alg", alg.Alg)
+			continue
+		}
+
 		banks := make([]types.BankData, 0)
-		hash, err := pcr.MeasureSections(alg.Alg, sectionsData)
+		hash, err := pcr.MeasureSectionsContent(alg.Alg, sectionsContent)
 		if err != nil {
 			return nil, err
 		}
 		for _, phase := range phases {
 			hash = pcr.MeasurePhase(phase, alg.Alg, hash)
-			bank, err := pcr.SignPolicy(PCR, alg.Alg, rsaKey, hash)
+			values[PCR] = hash.Hash()
+			bank, err := pcr.SignPolicyPCRs(values, alg.Alg, rsaKey)
 			if err != nil {
 				return nil, err
 			}
 			banks = append(banks, bank)
 		}
 		*alg.BankDataSetter = banks
+		signed = true
+	}
+
+	if !signed {
+		return nil, errors.New("none of the PCR banks has a value for all the PCRs of the policy")
 	}
 
 	return data, nil
 }
 
 // GenerateMeasurements generates the PCR measurements for a given set of UKI file sections and phases
-func GenerateMeasurements(sectionsData SectionsData, phases []types.PhaseInfo, PCR int) {
-	slog.Debug("Generating PCR data", "sections", sectionsData)
+func GenerateMeasurements(sectionsData SectionsData, phases []types.PhaseInfo, PCR int) error {
+	sectionsContent, err := readSections(sectionsData)
+	if err != nil {
+		return err
+	}
+
+	GenerateMeasurementsForContent(sectionsContent, phases, PCR)
+
+	return nil
+}
+
+// GenerateMeasurementsForContent generates the PCR measurements for the given contents of the UKI file sections and phases
+func GenerateMeasurementsForContent(sectionsContent SectionsContent, phases []types.PhaseInfo, PCR int) {
+	slog.Debug("Generating PCR data", "sections", sectionNames(sectionsContent))
 	slog.Info("Not signing data, just outputting it to stdout")
 	slog.Info("legend: <PHASE:PCR:ALGORITHM=HASH>")
 
 	_, algos := types.GetTPMALGorithm()
 	for _, alg := range algos {
-		hash, _ := pcr.MeasureSections(alg.Alg, sectionsData)
+		hash, _ := pcr.MeasureSectionsContent(alg.Alg, sectionsContent)
 		for _, phase := range phases {
 			pcr.MeasurePhase(phase, alg.Alg, hash)
 			al, _ := alg.Alg.Hash()
@@ -65,6 +126,33 @@ func GenerateMeasurements(sectionsData SectionsData, phases []types.PhaseInfo, P
 	}
 }
 
+// readSections reads the contents of the given section files.
+func readSections(sectionsData SectionsData) (SectionsContent, error) {
+	sectionsContent := SectionsContent{}
+	for section, path := range sectionsData {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sectionsContent[section] = data
+	}
+	return sectionsContent, nil
+}
+
+// sectionNames returns the names of the sections in sectionsContent, for logging.
+func sectionNames(sectionsContent SectionsContent) []constants.Section {
+	names := make([]constants.Section, 0, len(sectionsContent))
+	for _, section := range constants.OrderedSections() {
+		if _, ok := sectionsContent[section]; ok {
+			names = append(names, section)
+		}
+	}
+	return names
+}
+
 func PrintSystemdMeasurements(phase string, sectionsData SectionsData, privKey string) {
 	args := []string{
 		"--cmdline", sectionsData[constants.CMDLine],
@@ -14,6 +14,7 @@ import (
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"log/slog"
 	"os"
+	"slices"
 )
 
 // CalculateBankData calculates the PCR bank data for a given set of UKI file sections.
@@ -99,6 +100,23 @@ func CalculateBankData(pcrNumber int, phases []types.PhaseInfo, alg tpm2.TPMAlgI
 
 // MeasureSections would measure the given sections for a given TPM algorithm
 func MeasureSections(alg tpm2.TPMAlgID, sectionData map[constants.Section]string) (*Digest, error) {
+	sectionContent := map[constants.Section][]byte{}
+
+	for _, section := range constants.OrderedSections() {
+		if file := sectionData[section]; file != "" {
+			sectionD, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			sectionContent[section] = sectionD
+		}
+	}
+
+	return MeasureSectionsContent(alg, sectionContent)
+}
+
+// MeasureSectionsContent would measure the given section contents for a given TPM algorithm
+func MeasureSectionsContent(alg tpm2.TPMAlgID, sectionContent map[constants.Section][]byte) (*Digest, error) {
 	var hashData *Digest
 
 	hashAlg, err := alg.Hash()
@@ -109,13 +127,9 @@ func MeasureSections(alg tpm2.TPMAlgID, sectionData map[constants.Section]string
 	hashData = NewDigest(hashAlg)
 
 	for _, section := range constants.OrderedSections() {
-		if file := sectionData[section]; file != "" {
+		if sectionD, ok := sectionContent[section]; ok {
 			slog.Debug("Measuring section", "section", section, "alg", hashAlg.String())
 
-			sectionD, err := os.ReadFile(file)
-			if err != nil {
-				return hashData, err
-			}
 			// NULL terminated, thats why we adding the 0 at the end
 			hashData.Extend(append([]byte(section), 0))
 			hashData.Extend(sectionD)
@@ -141,11 +155,39 @@ func MeasurePhase(phase types.PhaseInfo, alg tpm2.TPMAlgID, hashData *Digest) *D
 
 // SignPolicy will calculate and sign a policy for a given Digest, PCR and algorithm
 func SignPolicy(pcrNumber int, alg tpm2.TPMAlgID, rsaKey types.RSAKey, hashData *Digest) (types.BankData, error) {
+	return SignPolicyPCRs(map[int][]byte{pcrNumber: hashData.Hash()}, alg, rsaKey)
+}
+
+// SignPolicyPCRs will calculate and sign a policy binding several PCRs of the algorithm bank to
+// the given values, such as the Secure Boot state in PCR 7 along with the UKI in PCR 11.
+func SignPolicyPCRs(pcrValues map[int][]byte, alg tpm2.TPMAlgID, rsaKey types.RSAKey) (types.BankData, error) {
 	var bankData types.BankData
-	hash := hashData.Hash()
 	pubKeyFingerprint := sha256.Sum256(x509.MarshalPKCS1PublicKey(rsaKey.PublicRSAKey()))
 
-	pcrSelector, err := CreateSelector([]int{pcrNumber})
+	hashAlg, err := alg.Hash()
+	if err != nil {
+		return bankData, err
+	}
+
+	pcrNumbers := make([]int, 0, len(pcrValues))
+	for pcrNumber := range pcrValues {
+		pcrNumbers = append(pcrNumbers, pcrNumber)
+	}
+
+	// the TPM digests the values of the selected PCRs in ascending order
+	slices.Sort(pcrNumbers)
+
+	var values []byte
+
+	for _, pcrNumber := range pcrNumbers {
+		if len(pcrValues[pcrNumber]) != hashAlg.Size() {
+			return bankData, fmt.Errorf("value of PCR %d is %d bytes long, expected %d for the %s bank", pcrNumber, len(pcrValues[pcrNumber]), hashAlg.Size(), hashAlg.String())
+		}
+
+		values = append(values, pcrValues[pcrNumber]...)
+	}
+
+	pcrSelector, err := CreateSelector(pcrNumbers)
 	if err != nil {
 		return bankData, fmt.Errorf("failed to create PCR selection: %v", err)
 	}
@@ -159,25 +201,24 @@ func SignPolicy(pcrNumber int, alg tpm2.TPMAlgID, rsaKey types.RSAKey, hashData
 		},
 	}
 
-	policyPCR, err := CalculatePolicy(hash, pcrSelection)
+	policyPCR, err := CalculatePolicy(values, pcrSelection)
 
 	if err != nil {
 		return bankData, err
 	}
 
-	hashAlg, err := alg.Hash()
-
 	sigData, err := Sign(policyPCR, hashAlg, rsaKey)
 	if err != nil {
 		return bankData, err
 	}
 
 	slog.Debug("signed policy", "PKFP", hex.EncodeToString(pubKeyFingerprint[:]))
+	slog.Debug("signed policy", "pcrs", pcrNumbers)
 	slog.Debug("signed policy", "pol", sigData.Digest)
 	slog.Debug("signed policy", "Sig", sigData.SignatureBase64)
 
 	return types.BankData{
-		PCRs: []int{pcrNumber},
+		PCRs: pcrNumbers,
 		PKFP: hex.EncodeToString(pubKeyFingerprint[:]),
 		Sig:  sigData.SignatureBase64,
 		Pol:  sigData.Digest,
@@ -205,7 +246,8 @@ func CreateSelector(pcrs []int) ([]byte, error) {
 	return mask, nil
 }
 
-// CalculatePolicy calculates the policy hash for a given PCR value and PCR selection.
+// CalculatePolicy calculates the policy hash for a given PCR value and PCR selection, pcrValue
+// being the values of the selected PCRs concatenated in order when several are selected.
 func CalculatePolicy(pcrValue []byte, pcrSelection tpm2.TPMLPCRSelection) ([]byte, error) {
 	calculator, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
 	if err != nil {
@@ -1,6 +1,7 @@
 package pcr
 
 import (
+	"crypto/sha256"
 	"github.com/google/go-tpm/tpm2"
 	"github.com/kairos-io/go-ukify/pkg/constants"
 	"github.com/kairos-io/go-ukify/pkg/pesign"
@@ -317,7 +318,71 @@ var _ = Describe("PCR tests", func() {
 
 			})
 		})
+		Describe("SignPolicyPCRs", func() {
+			pcr7 := sha256.Sum256([]byte("pcr7"))
+			pcr11 := sha256.Sum256([]byte("pcr11"))
 
+			It("Signs the same policy as SignPolicy for a single PCR", func() {
+				hashAlg, err := tpm2.TPMAlgSHA256.Hash()
+				Expect(err).ToNot(HaveOccurred())
+				hashData := NewDigest(hashAlg)
+				hashData.Extend([]byte("enter-initrd"))
+
+				bank, err := SignPolicyPCRs(map[int][]byte{11: hashData.Hash()}, tpm2.TPMAlgSHA256, pcrsigner)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bank.PCRs).To(Equal([]int{11}))
+				Expect(bank.Pol).To(Equal(knowPCR11PolicyHashFirstPhase))
+
+				single, err := SignPolicy(11, tpm2.TPMAlgSHA256, pcrsigner, hashData)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(single).To(Equal(bank))
+			})
+
+			It("Binds the values of several PCRs in ascending order", func() {
+				// calculated independently, as SHA256(0^32 || TPM_CC_PolicyPCR || PCR 7+11 selection || SHA256(pcr7 || pcr11))
+				const pol = "d6f3bda3273b8c5466956ac6fcaa07349f351a6cfa7d8e928819c8224179737b"
+
+				bank, err := SignPolicyPCRs(map[int][]byte{11: pcr11[:], 7: pcr7[:]}, tpm2.TPMAlgSHA256, pcrsigner)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bank.PCRs).To(Equal([]int{7, 11}))
+				Expect(bank.Pol).To(Equal(pol))
+			})
+
+			It("Rejects values of the wrong size for the bank", func() {
+				_, err := SignPolicyPCRs(map[int][]byte{7: pcr7[:], 11: pcr11[:]}, tpm2.TPMAlgSHA1, pcrsigner)
+				Expect(err).To(MatchError(ContainSubstring("expected 20 for the SHA-1 bank")))
+			})
+		})
+
+	})
+	Describe("MeasureSectionsContent", func() {
+		It("Measures the sections in the systemd-stub order", func() {
+			extend := func(pcr []byte, data []byte) []byte {
+				dataSum := sha256.Sum256(data)
+				sum := sha256.Sum256(append(pcr, dataSum[:]...))
+				return sum[:]
+			}
+
+			expected := make([]byte, sha256.Size)
+			for _, section := range []struct{ name, data string }{
+				{".linux", "kernel"},
+				{".cmdline", "root=LABEL=BOOT"},
+				{".dtb", "dtb"},
+				{".uname", "6.5.0"},
+			} {
+				expected = extend(expected, []byte(section.name+"\x00"))
+				expected = extend(expected, []byte(section.data))
+			}
+
+			hash, err := MeasureSectionsContent(tpm2.TPMAlgSHA256, map[constants.Section][]byte{
+				constants.Uname:   []byte("6.5.0"),
+				constants.DTB:     []byte("dtb"),
+				constants.CMDLine: []byte("root=LABEL=BOOT"),
+				constants.Linux:   []byte("kernel"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hash.Hash()).To(Equal(expected))
+		})
 	})
 	Describe("Extend", func() {
 		It("Extends the hash properly", func() {
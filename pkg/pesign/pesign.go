@@ -6,6 +6,7 @@
 package pesign
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
@@ -51,65 +52,78 @@ func (s *Signer) Sign(input, output string) error {
 		return fmt.Errorf("failed getting input file info: %w", err)
 	}
 
-	ok, err := s.VerifyFile(input)
-	if ok {
-		slog.Warn("File is already signed with the cert, copying it into output file")
-		// already signed with the cert
-		// just copy it to the output place
-		f, err := os.ReadFile(input)
-		if err != nil {
-			return fmt.Errorf("failed reading input file: %w", err)
-		}
-		if err = os.WriteFile(output, f, si.Mode()); err != nil {
-			return fmt.Errorf("failed writing output file: %w", err)
-		}
-		return nil
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("failed reading input file: %w", err)
 	}
 
-	peFile, err := os.Open(input)
+	signed, err := s.SignData(data)
 	if err != nil {
 		return err
 	}
-	defer peFile.Close()
 
-	peBinary, err := authenticode.Parse(peFile)
+	if err = os.WriteFile(output, signed, si.Mode()); err != nil {
+		return fmt.Errorf("failed writing output file: %w", err)
+	}
+
+	return nil
+}
+
+// SignData signs the PE binary in data and returns the signed binary.
+//
+// If data is already signed with the cert, it is returned as is.
+func (s *Signer) SignData(data []byte) ([]byte, error) {
+	ok, err := s.VerifyData(data)
+	if ok {
+		slog.Warn("File is already signed with the cert, not signing it again")
+		return data, nil
+	}
+
+	peBinary, err := authenticode.Parse(bytes.NewReader(data))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = peBinary.Sign(s.provider.Signer(), s.provider.Certificate())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err = os.WriteFile(output, peBinary.Bytes(), si.Mode()); err != nil {
-		return err
-	}
+	signed := peBinary.Bytes()
 
 	// Now verify the output just in case
-	ok, err = s.VerifyFile(output)
+	ok, err = s.VerifyData(signed)
 	if !ok || err != nil {
-		return fmt.Errorf("failed verifying output file: %w", err)
+		return nil, fmt.Errorf("failed verifying output file: %w", err)
 	}
 
-	return nil
+	return signed, nil
 }
 
 func (s *Signer) VerifyFile(file string) (bool, error) {
-	peFile, err := os.Open(file)
+	data, err := os.ReadFile(file)
 	if err != nil {
 		return false, err
 	}
-	defer peFile.Close()
 
-	peBinary, err := authenticode.Parse(peFile)
+	ok, err := s.VerifyData(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return ok, nil
+}
+
+// VerifyData checks whether the PE binary in data is signed with the cert.
+func (s *Signer) VerifyData(data []byte) (bool, error) {
+	peBinary, err := authenticode.Parse(bytes.NewReader(data))
 	if err != nil {
 		return false, err
 	}
 
 	sigs, err := peBinary.Signatures()
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", file, err)
+		return false, err
 	}
 
 	if len(sigs) == 0 {
@@ -0,0 +1,179 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sbat parses SBAT metadata, and checks it against the SBAT revocations of shim.
+//
+// See https://github.com/rhboot/shim/blob/main/SBAT.md.
+package sbat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Header is the line every SBAT starts with, giving the version of the SBAT format.
+const Header = "sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md"
+
+// Entry is a line of the SBAT of an EFI binary.
+type Entry struct {
+	// Component is the name of the component, which revocations refer to.
+	Component string
+	// Generation of the component, bumped on each security fix.
+	Generation int
+	// Vendor fields, which are informative.
+	VendorName    string
+	VendorPackage string
+	VendorVersion string
+	VendorURL     string
+}
+
+// String returns the SBAT line of the entry.
+func (entry Entry) String() string {
+	return strings.Join([]string{
+		entry.Component, strconv.Itoa(entry.Generation), entry.VendorName, entry.VendorPackage, entry.VendorVersion, entry.VendorURL,
+	}, ",")
+}
+
+// Parse parses SBAT CSV, as found in the .sbat section of EFI binaries.
+func Parse(data []byte) ([]Entry, error) {
+	// the section is padded with NULs past its content
+	text := strings.TrimRight(string(bytes.TrimRight(data, "\x00")), "\n")
+	if text == "" {
+		return nil, errors.New("SBAT is empty")
+	}
+
+	lines := strings.Split(text, "\n")
+	entries := make([]Entry, 0, len(lines))
+
+	for i, line := range lines {
+		// component_name,component_generation,vendor_name,vendor_package_name,vendor_version,vendor_url
+		fields := strings.Split(line, ",")
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("SBAT line %d has %d fields, expected at least 6: %q", i+1, len(fields), line)
+		}
+
+		if fields[0] == "" {
+			return nil, fmt.Errorf("SBAT line %d has an empty component name", i+1)
+		}
+
+		generation, err := strconv.Atoi(fields[1])
+		if err != nil || generation < 1 {
+			return nil, fmt.Errorf("SBAT line %d has an invalid generation %q", i+1, fields[1])
+		}
+
+		if i == 0 && fields[0] != "sbat" {
+			return nil, fmt.Errorf("SBAT must start with the sbat version line, found %q", line)
+		}
+
+		entries = append(entries, Entry{
+			Component:     fields[0],
+			Generation:    generation,
+			VendorName:    fields[2],
+			VendorPackage: fields[3],
+			VendorVersion: fields[4],
+			// the URL is the last field, later ones are ignored by shim
+			VendorURL: fields[5],
+		})
+	}
+
+	return entries, nil
+}
+
+// Revocation is the minimum generation of a component which shim still loads.
+type Revocation struct {
+	Component  string
+	Generation int
+}
+
+// Level is an SbatLevel revocation policy, as stored by shim in the SbatLevel UEFI variable.
+type Level struct {
+	// Date of the policy, as given on its sbat line.
+	Date string
+	// Revocations of the policy, in order, starting with the one of the SBAT format version of its
+	// sbat line.
+	Revocations []Revocation
+}
+
+// ParseLevel parses an SbatLevel revocation policy, e.g.
+//
+//	sbat,1,2023012900
+//	shim,2
+//	grub,3
+//
+// Empty lines and lines starting with # are ignored.
+func ParseLevel(data []byte) (*Level, error) {
+	var level *Level
+
+	for i, line := range strings.Split(string(bytes.TrimRight(data, "\x00")), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("SbatLevel line %d is not a component,generation pair: %q", i+1, line)
+		}
+
+		generation, err := strconv.Atoi(fields[1])
+		if err != nil || generation < 1 {
+			return nil, fmt.Errorf("SbatLevel line %d has an invalid generation %q", i+1, fields[1])
+		}
+
+		if fields[0] == "sbat" {
+			if level != nil {
+				return nil, fmt.Errorf("SbatLevel line %d starts another policy, only one is supported", i+1)
+			}
+
+			level = &Level{}
+			if len(fields) > 2 {
+				level.Date = fields[2]
+			}
+		}
+
+		if level == nil {
+			return nil, fmt.Errorf("SbatLevel must start with the sbat line, found %q", line)
+		}
+
+		level.Revocations = append(level.Revocations, Revocation{Component: fields[0], Generation: generation})
+	}
+
+	if level == nil {
+		return nil, errors.New("SbatLevel is empty")
+	}
+
+	return level, nil
+}
+
+// Violation is an SBAT entry revoked by a policy.
+type Violation struct {
+	Entry Entry
+	// Required is the minimum generation the policy allows.
+	Required int
+}
+
+// String describes the violation.
+func (violation Violation) String() string {
+	return fmt.Sprintf("%s generation %d is revoked, generation %d or newer is required",
+		violation.Entry.Component, violation.Entry.Generation, violation.Required)
+}
+
+// Check returns the entries which the revocation policy revokes, for which shim would refuse the
+// binary, as it does when any of its components is older than the policy requires.
+func Check(entries []Entry, level *Level) []Violation {
+	var violations []Violation
+
+	for _, entry := range entries {
+		for _, revocation := range level.Revocations {
+			if revocation.Component == entry.Component && entry.Generation < revocation.Generation {
+				violations = append(violations, Violation{Entry: entry, Required: revocation.Generation})
+			}
+		}
+	}
+
+	return violations
+}
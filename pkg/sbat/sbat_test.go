@@ -0,0 +1,109 @@
+// external test package, as ginkgo's dot import would clash with Entry
+package sbat_test
+
+import (
+	"testing"
+
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SBAT test Suite")
+}
+
+const stubSBAT = sbat.Header + `
+systemd,1,The systemd Developers,systemd,254,https://systemd.io/
+systemd.fedora,1,Fedora Linux,systemd,254.10-1.fc39,https://bugzilla.redhat.com/
+`
+
+var _ = Describe("SBAT tests", func() {
+	Describe("Parse", func() {
+		It("Parses the SBAT of an EFI binary", func() {
+			entries, err := sbat.Parse([]byte(stubSBAT + "\x00\x00\x00"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(3))
+			Expect(entries[1]).To(Equal(sbat.Entry{
+				Component:     "systemd",
+				Generation:    1,
+				VendorName:    "The systemd Developers",
+				VendorPackage: "systemd",
+				VendorVersion: "254",
+				VendorURL:     "https://systemd.io/",
+			}))
+			Expect(entries[0].String()).To(Equal(sbat.Header))
+		})
+
+		It("Rejects malformed SBAT", func() {
+			_, err := sbat.Parse([]byte("\x00"))
+			Expect(err).To(MatchError("SBAT is empty"))
+
+			_, err = sbat.Parse([]byte("systemd,1,The systemd Developers,systemd,254,https://systemd.io/\n"))
+			Expect(err).To(MatchError(ContainSubstring("sbat version line")))
+
+			_, err = sbat.Parse([]byte(sbat.Header + "\nsystemd,0,The systemd Developers,systemd,254,https://systemd.io/\n"))
+			Expect(err).To(MatchError(ContainSubstring("invalid generation")))
+		})
+	})
+
+	Describe("ParseLevel", func() {
+		It("Parses a revocation policy", func() {
+			level, err := sbat.ParseLevel([]byte("# latest\n\nsbat,1,2024010900\nshim,4\ngrub,4\ngrub.proxmox,2\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(level).To(Equal(&sbat.Level{
+				Date: "2024010900",
+				Revocations: []sbat.Revocation{
+					{Component: "sbat", Generation: 1}, {Component: "shim", Generation: 4}, {Component: "grub", Generation: 4}, {Component: "grub.proxmox", Generation: 2},
+				},
+			}))
+		})
+
+		It("Rejects malformed policies", func() {
+			_, err := sbat.ParseLevel([]byte("# nothing\n"))
+			Expect(err).To(MatchError("SbatLevel is empty"))
+
+			_, err = sbat.ParseLevel([]byte("shim,4\n"))
+			Expect(err).To(MatchError(ContainSubstring("must start with the sbat line")))
+
+			_, err = sbat.ParseLevel([]byte("sbat,1,2024010900\nshim\n"))
+			Expect(err).To(MatchError(ContainSubstring("not a component,generation pair")))
+
+			_, err = sbat.ParseLevel([]byte("sbat,1,2023012900\nshim,2\nsbat,1,2024010900\nshim,4\n"))
+			Expect(err).To(MatchError(ContainSubstring("only one is supported")))
+		})
+	})
+
+	Describe("Check", func() {
+		var entries []sbat.Entry
+
+		BeforeEach(func() {
+			var err error
+
+			entries, err = sbat.Parse([]byte(stubSBAT))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Accepts binaries at or above the revoked generations", func() {
+			level := &sbat.Level{Revocations: []sbat.Revocation{{Component: "shim", Generation: 4}, {Component: "systemd", Generation: 1}, {Component: "systemd.fedora", Generation: 1}}}
+			Expect(sbat.Check(entries, level)).To(BeEmpty())
+		})
+
+		It("Reports the revoked components", func() {
+			level := &sbat.Level{Revocations: []sbat.Revocation{{Component: "systemd", Generation: 2}, {Component: "grub", Generation: 4}}}
+			violations := sbat.Check(entries, level)
+			Expect(violations).To(Equal([]sbat.Violation{{Entry: entries[1], Required: 2}}))
+			Expect(violations[0].String()).To(Equal("systemd generation 1 is revoked, generation 2 or newer is required"))
+		})
+
+		It("Refuses binaries older than the SBAT version of the policy", func() {
+			level, err := sbat.ParseLevel([]byte("sbat,2,2025010100\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			violations := sbat.Check(entries, level)
+			Expect(violations).To(Equal([]sbat.Violation{{Entry: entries[0], Required: 2}}))
+			Expect(violations[0].String()).To(Equal("sbat generation 1 is revoked, generation 2 or newer is required"))
+		})
+	})
+})
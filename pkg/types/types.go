@@ -3,6 +3,7 @@ package types
 import (
 	"crypto"
 	"crypto/rsa"
+	"os"
 	"strings"
 
 	"github.com/google/go-tpm/tpm2"
@@ -17,6 +18,14 @@ type PCRData struct {
 	SHA512 []BankData `json:"sha512,omitempty"`
 }
 
+// Append adds the policies of other to the ones of data.
+func (data *PCRData) Append(other *PCRData) {
+	data.SHA1 = append(data.SHA1, other.SHA1...)
+	data.SHA256 = append(data.SHA256, other.SHA256...)
+	data.SHA384 = append(data.SHA384, other.SHA384...)
+	data.SHA512 = append(data.SHA512, other.SHA512...)
+}
+
 // BankData constains data for a specific PCR bank.
 type BankData struct {
 	// list of PCR banks
@@ -57,6 +66,14 @@ func GetTPMALGorithm() (*PCRData, []Algorithm) {
 	return data, algs
 }
 
+// PCRValue is the value a PCR is expected to have in a bank, for signed policies binding it along
+// with the PCR the UKI is measured to.
+type PCRValue struct {
+	PCR   int
+	Alg   tpm2.TPMAlgID
+	Value []byte
+}
+
 // PhaseInfo describes which phase extensions are signed/measured.
 type PhaseInfo struct {
 	Phase constants.Phase
@@ -105,6 +122,8 @@ type UkiSection struct {
 	Name constants.Section
 	// Path to the contents of the section.
 	Path string
+	// Contents of the section, used when Path is empty.
+	Data []byte
 	// Should the section be measured to the TPM?
 	Measure bool
 	// Should the section be appended, or is it already in the PE file.
@@ -114,6 +133,15 @@ type UkiSection struct {
 	VMA  uint64
 }
 
+// Content returns the contents of the section, reading them from Path if set.
+func (s UkiSection) Content() ([]byte, error) {
+	if s.Path == "" {
+		return s.Data, nil
+	}
+
+	return os.ReadFile(s.Path)
+}
+
 // RSAKey is the input for the CalculateBankData function.
 type RSAKey interface {
 	crypto.Signer
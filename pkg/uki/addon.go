@@ -0,0 +1,247 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// AddonBuilder is a systemd-stub addon file builder.
+//
+// Addons are built from the addon stub, and only carry the sections which extend the UKI that
+// loads them. systemd-stub loads signed addons from the <uki>.extra.d/ directory next to the UKI,
+// and from the loader/addons/ directory of the ESP. Addon files have to be named *.addon.efi.
+type AddonBuilder struct {
+	// Source options.
+	//
+	// Arch of the addon file, detected from the addon stub if empty.
+	Arch string
+	// Path to the addon stub, defaults to the systemd one for Arch.
+	AddonStubPath string
+	// AddonStub is read instead of AddonStubPath when set.
+	AddonStub io.Reader
+	// Kernel cmdline, appended to the one of the UKI.
+	Cmdline string
+	// Path to the devicetree blob.
+	DTBPath string
+	// Path to the microcode, as a cpio archive or a raw Intel or AMD blob.
+	UCodePath string
+	// Path to the initrd image, loaded after the one of the UKI.
+	InitrdPath string
+	// SBAT entries added to the ones of the addon stub, defaults to constants.AddonSBAT.
+	SBAT string
+
+	// SecureBoot certificate and signer.
+	SecureBootSigner *pesign.Signer
+	// SecureBoot key
+	SBKey string
+	// SecureBoot cert
+	SBCert string
+
+	// Reproducible and SourceDateEpoch work as in Builder.
+	Reproducible    bool
+	SourceDateEpoch int64
+
+	// Output options:
+	//
+	// Path to the output addon file.
+	OutAddonPath string
+
+	// fields initialized during build
+	stubData []byte
+	sections []types.UkiSection
+}
+
+// Build the addon file, and write it to the OutAddonPath.
+func (builder *AddonBuilder) Build() error {
+	var addon bytes.Buffer
+
+	if err := builder.BuildTo(&addon); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(builder.OutAddonPath, addon.Bytes(), 0o600); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("Addon at %s", builder.OutAddonPath))
+
+	return nil
+}
+
+// BuildTo builds the addon file in memory and writes it to w.
+//
+// The addon is signed if a SecureBoot signer or key/cert pair is given, as systemd-stub
+// only loads signed addons when SecureBoot is enabled.
+func (builder *AddonBuilder) BuildTo(w io.Writer) error {
+	var err error
+
+	builder.sections = nil
+
+	if builder.SecureBootSigner == nil && builder.SBCert != "" && builder.SBKey != "" {
+		if builder.SecureBootSigner, err = newSecureBootSigner(builder.SBCert, builder.SBKey); err != nil {
+			return err
+		}
+	}
+
+	if builder.AddonStub == nil && builder.AddonStubPath == "" {
+		name := builder.Arch
+		if name == "" {
+			name = runtime.GOARCH
+		}
+
+		arch, err := LookupArch(name)
+		if err != nil {
+			return err
+		}
+
+		builder.AddonStubPath = arch.DefaultAddonStubPath()
+	}
+
+	if builder.stubData, err = readInput(builder.AddonStub, builder.AddonStubPath); err != nil {
+		return fmt.Errorf("error reading addon stub: %w", err)
+	}
+
+	stub, err := pe.NewFile(bytes.NewReader(builder.stubData))
+	if err != nil {
+		return err
+	}
+
+	defer stub.Close() //nolint:errcheck
+
+	if err = builder.checkArch(stub); err != nil {
+		return err
+	}
+
+	if err = builder.generateSections(stub); err != nil {
+		return fmt.Errorf("error generating sections: %w", err)
+	}
+
+	info, err := stubInfo(stub)
+	if err != nil {
+		return fmt.Errorf("failed to detect addon stub version: %w", err)
+	}
+
+	if info.Name != "" && info.Name != "systemd-addon" {
+		slog.Warn("The addon stub does not look like a systemd-addon", "path", builder.AddonStubPath, "stub", info.String())
+	}
+
+	if err = checkStubSupport(info, builder.sections); err != nil {
+		return err
+	}
+
+	slog.Info("Assembling addon")
+
+	addon, err := assemblePE(builder.stubData, builder.sections, builder.Reproducible, builder.SourceDateEpoch)
+	if err != nil {
+		return fmt.Errorf("error assembling addon: %w", err)
+	}
+
+	if builder.SecureBootSigner != nil {
+		slog.Info("Signing addon")
+
+		if addon, err = builder.SecureBootSigner.SignData(addon); err != nil {
+			return fmt.Errorf("error signing addon: %w", err)
+		}
+	} else {
+		slog.Warn("Not signing addon, systemd-stub will refuse to load it with SecureBoot enabled")
+	}
+
+	_, err = w.Write(addon)
+
+	return err
+}
+
+// checkArch makes sure the addon stub matches Arch, if given.
+func (builder *AddonBuilder) checkArch(stub *pe.File) error {
+	if builder.Arch == "" {
+		return nil
+	}
+
+	arch, err := LookupArch(builder.Arch)
+	if err != nil {
+		return err
+	}
+
+	if stub.FileHeader.Machine != arch.Machine {
+		return fmt.Errorf("addon stub has PE machine type 0x%x, expected 0x%x for %s", stub.FileHeader.Machine, arch.Machine, arch.Name)
+	}
+
+	return nil
+}
+
+// generateSections builds the list of sections of the addon, merging its SBAT entries with the ones of the stub.
+func (builder *AddonBuilder) generateSections(stub *pe.File) error {
+	if builder.Cmdline != "" {
+		// the cmdline length is not checked for stubs of unknown archs
+		arch, _ := archForMachine(stub.FileHeader.Machine)
+		if err := validateCmdline(builder.Cmdline, arch); err != nil {
+			return err
+		}
+
+		builder.sections = append(builder.sections, types.UkiSection{Name: constants.CMDLine, Data: []byte(builder.Cmdline), Append: true})
+	}
+
+	if builder.DTBPath != "" {
+		dtb, err := readDTB(builder.DTBPath)
+		if err != nil {
+			return err
+		}
+
+		builder.sections = append(builder.sections, types.UkiSection{Name: constants.DTB, Data: dtb, Append: true})
+	}
+
+	if builder.UCodePath != "" {
+		arch, err := archForMachine(stub.FileHeader.Machine)
+		if err != nil {
+			return err
+		}
+
+		ucode, err := readMicrocode(arch, []string{builder.UCodePath})
+		if err != nil {
+			return err
+		}
+
+		builder.sections = append(builder.sections, types.UkiSection{Name: constants.UCode, Data: ucode, Append: true})
+	}
+
+	if builder.InitrdPath != "" {
+		builder.sections = append(builder.sections, types.UkiSection{Name: constants.Initrd, Path: builder.InitrdPath, Append: true})
+	}
+
+	if len(builder.sections) == 0 {
+		return errors.New("addon has no sections, give at least a cmdline, devicetree, microcode or initrd")
+	}
+
+	stubSBAT, err := sectionContent(stub, string(constants.SBAT))
+	if err != nil {
+		return err
+	}
+
+	sbat := builder.SBAT
+	if sbat == "" {
+		sbat = constants.AddonSBAT
+	}
+
+	merged := mergeSBAT(stubSBAT, []byte(sbat))
+	if err = ValidateSBAT(merged); err != nil {
+		return fmt.Errorf("invalid SBAT: %w", err)
+	}
+
+	builder.sections = append(builder.sections, types.UkiSection{Name: constants.SBAT, Data: merged, Append: true})
+
+	return nil
+}
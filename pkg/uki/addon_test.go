@@ -0,0 +1,60 @@
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/sbat"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AddonBuilder", func() {
+	var stub []byte
+
+	BeforeEach(func() {
+		var err error
+		stub, err = os.ReadFile("testdata/sd-boot.efi")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Builds a cmdline addon", func() {
+		builder := &AddonBuilder{AddonStub: bytes.NewReader(stub), Cmdline: "quiet"}
+
+		var addon bytes.Buffer
+		Expect(builder.BuildTo(&addon)).To(Succeed())
+
+		peFile, err := pe.NewFile(bytes.NewReader(addon.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		defer peFile.Close()
+
+		cmdline, err := sectionContent(peFile, string(constants.CMDLine))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(cmdline)).To(Equal("quiet"))
+		Expect(peFile.Section(string(constants.Linux))).To(BeNil())
+
+		// the SBAT of the stub is extended, not duplicated
+		Expect(containsSection(peFile.Sections, constants.SBAT)).To(BeTrue())
+		Expect(peFile.Sections).To(HaveLen(8))
+
+		content, err := sectionContent(peFile, string(constants.SBAT))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ValidateSBAT(content)).To(Succeed())
+		Expect(string(content)).To(HavePrefix(sbat.Header + "\nsystemd,1,"))
+		Expect(string(content)).To(HaveSuffix(constants.AddonSBAT))
+		Expect(bytes.Count(content, []byte(sbat.Header))).To(Equal(1))
+	})
+
+	It("Refuses to build an empty addon", func() {
+		builder := &AddonBuilder{AddonStub: bytes.NewReader(stub)}
+		Expect(builder.BuildTo(&bytes.Buffer{})).To(MatchError(ContainSubstring("addon has no sections")))
+	})
+
+	It("Checks the arch of the addon stub", func() {
+		builder := &AddonBuilder{Arch: "aarch64", AddonStub: bytes.NewReader(stub), Cmdline: "quiet"}
+		Expect(builder.BuildTo(&bytes.Buffer{})).To(MatchError(ContainSubstring("addon stub has PE machine type")))
+	})
+})
@@ -0,0 +1,178 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Arch describes an architecture UKIs can be built for.
+type Arch struct {
+	// Name is the canonical name of the architecture, as used by uname.
+	Name string
+	// EFIName is the suffix systemd uses for the EFI binaries of this architecture.
+	EFIName string
+	// Machine is the PE machine type of the EFI binaries of this architecture.
+	Machine uint16
+}
+
+// architectures lists the supported architectures, keyed by their canonical name.
+var architectures = map[string]Arch{
+	"x86_64":      {Name: "x86_64", EFIName: "x64", Machine: pe.IMAGE_FILE_MACHINE_AMD64},
+	"ia32":        {Name: "ia32", EFIName: "ia32", Machine: pe.IMAGE_FILE_MACHINE_I386},
+	"aarch64":     {Name: "aarch64", EFIName: "aa64", Machine: pe.IMAGE_FILE_MACHINE_ARM64},
+	"riscv64":     {Name: "riscv64", EFIName: "riscv64", Machine: pe.IMAGE_FILE_MACHINE_RISCV64},
+	"loongarch64": {Name: "loongarch64", EFIName: "loongarch64", Machine: pe.IMAGE_FILE_MACHINE_LOONGARCH64},
+}
+
+// archAliases maps the other common spellings of an architecture to its canonical name.
+var archAliases = map[string]string{
+	"amd64":   "x86_64",
+	"x64":     "x86_64",
+	"386":     "ia32",
+	"i386":    "ia32",
+	"i686":    "ia32",
+	"x86":     "ia32",
+	"arm64":   "aarch64",
+	"aa64":    "aarch64",
+	"loong64": "loongarch64",
+}
+
+// LookupArch returns the architecture for the given name or alias.
+func LookupArch(name string) (Arch, error) {
+	name = strings.ToLower(name)
+	if alias, ok := archAliases[name]; ok {
+		name = alias
+	}
+
+	arch, ok := architectures[name]
+	if !ok {
+		return Arch{}, fmt.Errorf("unsupported arch %q", name)
+	}
+
+	return arch, nil
+}
+
+// archForMachine returns the architecture for the given PE machine type.
+func archForMachine(machine uint16) (Arch, error) {
+	for _, arch := range architectures {
+		if arch.Machine == machine {
+			return arch, nil
+		}
+	}
+
+	return Arch{}, fmt.Errorf("unsupported PE machine type 0x%x", machine)
+}
+
+// DefaultSdStubPath returns the path the sd-stub for the given architecture is usually installed at.
+func (arch Arch) DefaultSdStubPath() string {
+	return fmt.Sprintf("/usr/lib/systemd/boot/efi/linux%s.efi.stub", arch.EFIName)
+}
+
+// DefaultAddonStubPath returns the path the addon stub for the given architecture is usually installed at.
+func (arch Arch) DefaultAddonStubPath() string {
+	return fmt.Sprintf("/usr/lib/systemd/boot/efi/addon%s.efi.stub", arch.EFIName)
+}
+
+// kernelMachines returns the PE machine types of the kernels the sd-stub of this architecture can boot.
+func (arch Arch) kernelMachines() []uint16 {
+	if arch.Machine == pe.IMAGE_FILE_MACHINE_I386 {
+		// ia32 firmware can boot x86_64 kernels in mixed mode
+		return []uint16{pe.IMAGE_FILE_MACHINE_I386, pe.IMAGE_FILE_MACHINE_AMD64}
+	}
+
+	return []uint16{arch.Machine}
+}
+
+// defaultSdStub picks the sd-stub of the host, or of Arch if given, when no sd-stub was given.
+func (builder *Builder) defaultSdStub() error {
+	if builder.SdStub != nil || builder.SdStubPath != "" {
+		return nil
+	}
+
+	name := builder.Arch
+	if name == "" {
+		name = runtime.GOARCH
+	}
+
+	arch, err := LookupArch(name)
+	if err != nil {
+		return err
+	}
+
+	builder.SdStubPath = arch.DefaultSdStubPath()
+
+	return nil
+}
+
+// resolveArch works out the architecture of the UKI, detecting it from the sd-stub if no arch was given.
+func (builder *Builder) resolveArch() error {
+	var err error
+
+	if builder.Arch != "" {
+		builder.arch, err = LookupArch(builder.Arch)
+		if err != nil {
+			return err
+		}
+	} else {
+		stub, err := pe.NewFile(bytes.NewReader(builder.stubData))
+		if err != nil {
+			return err
+		}
+
+		defer stub.Close() //nolint:errcheck
+
+		builder.arch, err = archForMachine(stub.FileHeader.Machine)
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.Debug("Using arch", "arch", builder.arch.Name)
+
+	return nil
+}
+
+// checkArch makes sure the sd-stub and the kernel match the architecture of the UKI.
+func (builder *Builder) checkArch() error {
+	stub, err := pe.NewFile(bytes.NewReader(builder.stubData))
+	if err != nil {
+		return err
+	}
+
+	defer stub.Close() //nolint:errcheck
+
+	if stub.FileHeader.Machine != builder.arch.Machine {
+		return fmt.Errorf("sd-stub has PE machine type 0x%x, expected 0x%x for %s", stub.FileHeader.Machine, builder.arch.Machine, builder.arch.Name)
+	}
+
+	kernel, err := pe.NewFile(bytes.NewReader(builder.kernelData))
+	if err != nil {
+		// only x86 kernels can still be started without a PE entry point, through the EFI handover protocol
+		if builder.arch.Machine != pe.IMAGE_FILE_MACHINE_AMD64 && builder.arch.Machine != pe.IMAGE_FILE_MACHINE_I386 {
+			return fmt.Errorf("kernel is not an EFI executable: %w", err)
+		}
+	} else {
+		defer kernel.Close() //nolint:errcheck
+
+		if !slices.Contains(builder.arch.kernelMachines(), kernel.FileHeader.Machine) {
+			return fmt.Errorf("kernel has PE machine type 0x%x, which cannot be booted on %s", kernel.FileHeader.Machine, builder.arch.Name)
+		}
+	}
+
+	if builder.arch.Machine == pe.IMAGE_FILE_MACHINE_I386 {
+		if err = checkKernelIA32Entry(builder.kernelData); err != nil {
+			return fmt.Errorf("kernel cannot be booted by the ia32 sd-stub: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -5,100 +5,99 @@
 package uki
 
 import (
-	"debug/pe"
-	"errors"
+	"bytes"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
-	"os/exec"
-	"path/filepath"
-)
+	"strconv"
 
-// assemble the UKI file out of sections.
-func (builder *Builder) assemble() error {
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
 
-	// Prefer llvm-objcopy when we have repeated section names (.profile/.cmdline)
-	useLLVM := len(builder.ExtraCmdlines) > 0
-	objcopy := "objcopy"
-	if useLLVM {
-		objcopy = "llvm-objcopy"
-	}
+// assemble the unsigned UKI file out of sections.
+func (builder *Builder) assemble() ([]byte, error) {
+	return assemblePE(builder.stubData, builder.sections, builder.Reproducible, builder.SourceDateEpoch)
+}
 
-	peFile, err := pe.Open(builder.SdStubPath)
+// assemblePE builds a PE file out of the stub and the sections to append, see Builder.Reproducible
+// and Builder.SourceDateEpoch for the timestamps.
+//
+// The .sbat section of the stub is replaced in place if there is one, as it cannot be there twice.
+func assemblePE(stub []byte, sections []types.UkiSection, reproducible bool, sourceDateEpoch int64) ([]byte, error) {
+	// work on a copy, so that the stub itself is left untouched
+	img, err := newPEImage(bytes.Clone(stub))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer peFile.Close() //nolint: errcheck
-
-	// find the first VMA address
-	lastSection := peFile.Sections[len(peFile.Sections)-1]
-
-	// align the VMA to 512 bytes
-	// https://github.com/saferwall/pe/blob/main/helper.go#L22-L26
-	const alignment = 0x1ff
+	// append the sections in order, calculating their size and VMA
+	for i := range sections {
+		if !sections[i].Append {
+			continue
+		}
 
-	header, ok := peFile.OptionalHeader.(*pe.OptionalHeader64)
-	if !ok {
-		return errors.New("failed to get optional header")
-	}
+		data, err := sections[i].Content()
+		if err != nil {
+			return nil, err
+		}
 
-	baseVMA := header.ImageBase + uint64(lastSection.VirtualAddress) + uint64(lastSection.VirtualSize)
-	baseVMA = (baseVMA + alignment) &^ alignment
+		var rva uint32
 
-	// calculate sections size and VMA
-	for i := range builder.sections {
-		if !builder.sections[i].Append {
-			continue
+		if sections[i].Name == constants.SBAT && img.sectionIndex(string(constants.SBAT)) != -1 {
+			rva, err = img.replaceSection(string(sections[i].Name), data)
+		} else {
+			rva, err = img.appendSection(string(sections[i].Name), data, sectionCharacteristics(sections[i].Name))
 		}
 
-		st, err := os.Stat(builder.sections[i].Path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		builder.sections[i].Size = uint64(st.Size())
-		builder.sections[i].VMA = baseVMA
+		sections[i].Size = uint64(len(data))
+		sections[i].VMA = img.imageBase + uint64(rva)
 
-		baseVMA += builder.sections[i].Size
-		baseVMA = (baseVMA + alignment) &^ alignment
+		slog.Debug("Assembling", "section", sections[i].Name, "size", sections[i].Size, "vma", sections[i].VMA)
 	}
 
-	// create the output file
-	args := []string{}
-
-	for _, section := range builder.sections {
-		if !section.Append {
-			continue
-		}
+	if timestamp, ok, err := getSourceDateEpoch(reproducible, sourceDateEpoch); err != nil {
+		return nil, err
+	} else if ok {
+		slog.Debug("Assembling reproducible PE file", "timestamp", timestamp)
 
-		args = append(args, "--add-section", fmt.Sprintf("%s=%s", section.Name, section.Path))
-		// llvm-objcopy does not support --change-section-vma; skip it and rely on order
-		if !useLLVM {
-			args = append(args, "--change-section-vma", fmt.Sprintf("%s=0x%x", section.Name, section.VMA))
+		if err = img.setTimestamp(timestamp); err != nil {
+			return nil, err
 		}
 	}
 
-	// Set the section flag to CODE for .linux not usre if this does anything?
-	args = append(args, "--set-section-flags", ".linux=code,readonly")
+	return img.Bytes()
+}
 
-	// mark all payload sections as readable (llvm-objcopy default lacks MEM_READ)
-	for _, sec := range []string{
-		".osrel", ".cmdline", ".initrd", ".splash", ".uname",
-		".pcrpkey", ".pcrsig", ".profile",
-	} {
-		args = append(args, "--set-section-flags", fmt.Sprintf("%s=data,readonly", sec))
-	}
+// getSourceDateEpoch returns the timestamp to store in the PE file, and whether the build is reproducible.
+//
+// See https://reproducible-builds.org/docs/source-date-epoch/.
+func getSourceDateEpoch(reproducible bool, sourceDateEpoch int64) (uint32, bool, error) {
+	epoch := sourceDateEpoch
 
-	builder.unsignedUKIPath = filepath.Join(builder.scratchDir, "unsigned.uki")
+	env, envSet := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if epoch == 0 && envSet {
+		var err error
 
-	args = append(args, builder.SdStubPath, builder.unsignedUKIPath)
+		epoch, err = strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+		}
+	}
 
-	slog.Debug("Assembling", "args", args)
+	if !reproducible && !envSet && sourceDateEpoch == 0 {
+		return 0, false, nil
+	}
 
-	cmd := exec.Command(objcopy, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// the COFF timestamp is a 32-bit value
+	if epoch < 0 || epoch > math.MaxUint32 {
+		return 0, false, fmt.Errorf("source date epoch %d does not fit in a PE timestamp", epoch)
+	}
 
-	return cmd.Run()
+	return uint32(epoch), true, nil
 }
@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// maxCmdlineSize is the COMMAND_LINE_SIZE of the kernel for each arch, including the NUL terminator.
+var maxCmdlineSize = map[string]int{
+	"x86_64":      2048,
+	"ia32":        2048,
+	"aarch64":     2048,
+	"riscv64":     1024,
+	"loongarch64": 4096,
+}
+
+// ReadCmdline reads a kernel cmdline file, as kernel-install reads /etc/kernel/cmdline: lines are
+// joined with spaces, and comment lines starting with # are ignored.
+func ReadCmdline(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var args []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			args = append(args, line)
+		}
+	}
+
+	return strings.Join(args, " "), nil
+}
+
+// renderCmdline expands the Go template in cmdline, with the fields of the os-release as
+// .OSRelease, e.g. {{ .OSRelease.IMAGE_VERSION }}, as well as .Version and .Arch.
+func (builder *Builder) renderCmdline(cmdline string) (string, error) {
+	if !strings.Contains(cmdline, "{{") {
+		return cmdline, nil
+	}
+
+	osRelease := map[string]string{}
+
+	for _, section := range builder.sections {
+		if section.Name != constants.OSRel {
+			continue
+		}
+
+		content, err := section.Content()
+		if err != nil {
+			return "", err
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			if field, ok, err := parseOSReleaseLine(line); err == nil && ok {
+				osRelease[field.key] = field.value
+			}
+		}
+	}
+
+	tmpl, err := template.New("cmdline").Option("missingkey=error").Parse(cmdline)
+	if err != nil {
+		return "", fmt.Errorf("invalid cmdline template: %w", err)
+	}
+
+	var rendered strings.Builder
+
+	err = tmpl.Execute(&rendered, map[string]any{
+		"OSRelease": osRelease,
+		"Version":   builder.Version,
+		"Arch":      builder.arch.Name,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error rendering cmdline: %w", err)
+	}
+
+	return rendered.String(), nil
+}
+
+// validateCmdline checks that the kernel of arch accepts cmdline.
+func validateCmdline(cmdline string, arch Arch) error {
+	if size, ok := maxCmdlineSize[arch.Name]; ok && len(cmdline) >= size {
+		return fmt.Errorf("cmdline is %d bytes long, the %s kernel only accepts up to %d", len(cmdline), arch.Name, size-1)
+	}
+
+	if !utf8.ValidString(cmdline) {
+		return fmt.Errorf("cmdline %q is not valid UTF-8", cmdline)
+	}
+
+	for _, c := range cmdline {
+		if c != ' ' && (unicode.IsControl(c) || unicode.IsSpace(c)) {
+			return fmt.Errorf("cmdline %q has the invalid character %q, arguments may only be separated by spaces", cmdline, c)
+		}
+	}
+
+	// the kernel lets arguments hold spaces in double quotes
+	if strings.Count(cmdline, `"`)%2 != 0 {
+		return fmt.Errorf("cmdline %q has an unterminated double quote", cmdline)
+	}
+
+	return nil
+}
+
+// resolveCmdline renders and validates a cmdline given to the Builder.
+func (builder *Builder) resolveCmdline(cmdline string) (string, error) {
+	rendered, err := builder.renderCmdline(cmdline)
+	if err != nil {
+		return "", err
+	}
+
+	rendered = strings.TrimSpace(rendered)
+
+	if err = validateCmdline(rendered, builder.arch); err != nil {
+		return "", err
+	}
+
+	return rendered, nil
+}
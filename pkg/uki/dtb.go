@@ -0,0 +1,197 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// FDT header constants, based on https://devicetree-specification.readthedocs.io/en/stable/flattened-format.html.
+const (
+	fdtMagic      = 0xd00dfeed
+	fdtHeaderSize = 40
+	// fdtVersion is the version of the format described by the specification, which is backwards
+	// compatible down to version 16.
+	fdtVersion = 17
+)
+
+// FDT structure block tokens.
+const (
+	fdtBeginNode = 1
+	fdtProp      = 3
+	fdtNop       = 4
+)
+
+// ValidateDTB checks that data starts with a sane flattened devicetree header.
+func ValidateDTB(data []byte) error {
+	if len(data) < fdtHeaderSize {
+		return errors.New("devicetree is too short to hold an FDT header")
+	}
+
+	field := func(i int) uint32 { return binary.BigEndian.Uint32(data[4*i:]) }
+
+	magic, totalSize, offStruct, offStrings := field(0), field(1), field(2), field(3)
+	version, lastCompVersion, sizeStrings, sizeStruct := field(5), field(6), field(8), field(9)
+
+	if magic != fdtMagic {
+		return fmt.Errorf("devicetree has an invalid FDT magic 0x%08x", magic)
+	}
+
+	if totalSize < fdtHeaderSize || uint64(totalSize) > uint64(len(data)) {
+		return fmt.Errorf("devicetree total size %d does not match its %d bytes", totalSize, len(data))
+	}
+
+	if version < 16 || lastCompVersion > fdtVersion {
+		return fmt.Errorf("unsupported FDT version %d, compatible with %d", version, lastCompVersion)
+	}
+
+	// the size of the structure block was only added with version 17
+	if version < 17 {
+		sizeStruct = 0
+	}
+
+	if uint64(offStruct)+uint64(sizeStruct) > uint64(totalSize) || uint64(offStrings)+uint64(sizeStrings) > uint64(totalSize) {
+		return errors.New("devicetree blocks extend past its total size")
+	}
+
+	return nil
+}
+
+// dtbCompatible returns the compatible strings of the root node of the devicetree, which must be valid.
+func dtbCompatible(data []byte) ([]string, error) {
+	offStruct := binary.BigEndian.Uint32(data[8:])
+	offStrings := binary.BigEndian.Uint32(data[12:])
+	totalSize := binary.BigEndian.Uint32(data[4:])
+
+	block := data[offStruct:totalSize]
+	dtStrings := data[offStrings:totalSize]
+
+	u32 := func(offset int) (uint32, error) {
+		if offset+4 > len(block) {
+			return 0, errors.New("devicetree structure block is truncated")
+		}
+
+		return binary.BigEndian.Uint32(block[offset:]), nil
+	}
+
+	offset := 0
+
+	for {
+		token, err := u32(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if token != fdtNop {
+			if token != fdtBeginNode {
+				return nil, fmt.Errorf("devicetree does not start with its root node, found token %d", token)
+			}
+
+			break
+		}
+
+		offset += 4
+	}
+
+	// skip the root node name, which is empty
+	name := bytes.IndexByte(block[offset+4:], 0)
+	if name == -1 {
+		return nil, errors.New("devicetree root node name is not terminated")
+	}
+
+	offset = int(alignUp(uint64(offset+4+name+1), 4))
+
+	// properties come before the subnodes
+	for {
+		token, err := u32(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		switch token {
+		case fdtNop:
+			offset += 4
+
+			continue
+		case fdtProp:
+		default:
+			return nil, errors.New("devicetree root node has no compatible property")
+		}
+
+		length, err := u32(offset + 4)
+		if err != nil {
+			return nil, err
+		}
+
+		nameOffset, err := u32(offset + 8)
+		if err != nil {
+			return nil, err
+		}
+
+		value := offset + 12
+		if uint64(value)+uint64(length) > uint64(len(block)) || nameOffset >= uint32(len(dtStrings)) {
+			return nil, errors.New("devicetree property extends past its block")
+		}
+
+		propName, _, _ := bytes.Cut(dtStrings[nameOffset:], []byte{0})
+		if string(propName) == "compatible" {
+			var compatible []string
+
+			for _, c := range bytes.Split(bytes.TrimRight(block[value:value+int(length)], "\x00"), []byte{0}) {
+				compatible = append(compatible, string(c))
+			}
+
+			return compatible, nil
+		}
+
+		offset = int(alignUp(uint64(value)+uint64(length), 4))
+	}
+}
+
+// readDTB reads the devicetree at path, and checks its header.
+func readDTB(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ValidateDTB(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return data, nil
+}
+
+func (builder *Builder) generateDTB() error {
+	if builder.DevicetreePath == "" {
+		return nil
+	}
+
+	slog.Debug("Using devicetree", "path", builder.DevicetreePath)
+
+	data, err := readDTB(builder.DevicetreePath)
+	if err != nil {
+		return err
+	}
+
+	builder.sections = append(builder.sections,
+		types.UkiSection{
+			Name:    constants.DTB,
+			Data:    data,
+			Measure: true,
+			Append:  true,
+		},
+	)
+
+	return nil
+}
@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+)
+
+// Credential is a systemd credential embedded in the initrd, as systemd-stub would pass it from
+// the ESP, see https://systemd.io/CREDENTIALS/.
+type Credential struct {
+	// Name of the credential.
+	Name string
+	// Path to the credential, usually encrypted with systemd-creds.
+	Path string
+}
+
+// ParseCredential parses a credential given as NAME=PATH, as accepted by Builder.Credentials.
+func ParseCredential(spec string) (Credential, error) {
+	name, path, ok := strings.Cut(spec, "=")
+	if !ok || name == "" || path == "" {
+		return Credential{}, fmt.Errorf("invalid credential %q, expected NAME=PATH", spec)
+	}
+
+	return Credential{Name: name, Path: path}, nil
+}
+
+// extraDir is the directory of the initrd where systemd-stub places the credentials and
+// extension images it picks up from the ESP.
+const extraDir = ".extra"
+
+// extraFile is a file of the extraDir of the initrd.
+type extraFile struct {
+	// dir is the subdirectory of extraDir.
+	dir string
+	// name in dir.
+	name string
+	path string
+	// dirMode and fileMode are the permissions of dir and of the file, which are only readable
+	// by root for credentials.
+	dirMode  fs.FileMode
+	fileMode fs.FileMode
+}
+
+// extraFiles lists the credentials and extension images, under the names systemd-stub gives them.
+func (builder *Builder) extraFiles() ([]extraFile, error) {
+	var files []extraFile
+
+	for _, credential := range builder.Credentials {
+		if credential.Name == "." || credential.Name == ".." || strings.ContainsAny(credential.Name, "/\x00") {
+			return nil, fmt.Errorf("invalid credential name %q", credential.Name)
+		}
+
+		files = append(files, extraFile{
+			dir:      "credentials",
+			name:     strings.TrimSuffix(credential.Name, ".cred") + ".cred",
+			path:     credential.Path,
+			dirMode:  0o500,
+			fileMode: 0o400,
+		})
+	}
+
+	for _, images := range []struct {
+		kind  string
+		paths []string
+	}{
+		{"sysext", builder.Sysexts},
+		{"confext", builder.Confexts},
+	} {
+		for _, path := range images.paths {
+			// systemd-sysext matches the name of the image against its extension-release file
+			name := filepath.Base(path)
+			if !strings.HasSuffix(name, "."+images.kind+".raw") {
+				return nil, fmt.Errorf("%s image %s has to be a .%s.raw file", images.kind, path, images.kind)
+			}
+
+			files = append(files, extraFile{dir: images.kind, name: name, path: path, dirMode: 0o555, fileMode: 0o444})
+		}
+	}
+
+	seen := map[string]bool{}
+
+	for _, file := range files {
+		if seen[file.dir+"/"+file.name] {
+			return nil, fmt.Errorf("%s is given twice", filepath.Join(extraDir, file.dir, file.name))
+		}
+
+		seen[file.dir+"/"+file.name] = true
+	}
+
+	return files, nil
+}
+
+// extraInitrd builds the cpio archive with the credentials, sysext and confext images, laid out
+// in /.extra with the permissions systemd-stub uses, or nil if there are none.
+func (builder *Builder) extraInitrd() ([]byte, error) {
+	files, err := builder.extraFiles()
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+
+	var archive bytes.Buffer
+
+	w := initrd.NewWriter(&archive)
+
+	if err = w.AddDir(extraDir, 0o555); err != nil {
+		return nil, err
+	}
+
+	for i, file := range files {
+		if i == 0 || files[i-1].dir != file.dir {
+			if err = w.AddDir(extraDir+"/"+file.dir, file.dirMode); err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Debug("Embedding in initrd", "path", file.path, "name", extraDir+"/"+file.dir+"/"+file.name)
+
+		if err = w.AddFile(extraDir+"/"+file.dir+"/"+file.name, file.fileMode, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return archive.Bytes(), nil
+}
@@ -5,15 +5,14 @@
 package uki
 
 import (
+	"bytes"
 	"crypto/x509"
+	"debug/pe"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"log/slog"
-	"os"
-	"path/filepath"
 
-	"github.com/kairos-io/go-ukify/internal/common"
 	"github.com/kairos-io/go-ukify/pkg/types"
 	"github.com/kairos-io/go-ukify/pkg/utils"
 
@@ -21,91 +20,49 @@ import (
 	"github.com/kairos-io/go-ukify/pkg/measure"
 )
 
-func (builder *Builder) generateOSRel() error {
-	var path string
-	if builder.OsRelease != "" {
-		slog.Debug("Using existing os-release", "path", builder.OsRelease)
-		path = builder.OsRelease
-	} else {
-		// Generate a simplified os-release
-		slog.Debug("Generating a new os-release")
-		osRelease, err := constants.OSReleaseFor(constants.Name, builder.Version)
-		if err != nil {
-			return err
-		}
-		path = filepath.Join(builder.scratchDir, "os-release")
-		if err = os.WriteFile(path, osRelease, 0o600); err != nil {
-			return err
-		}
+func (builder *Builder) generateCmdline() error {
+	cmdline, err := builder.resolveCmdline(builder.Cmdline)
+	if err != nil {
+		return err
 	}
 
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.OSRel,
-			Path:    path,
-			Measure: true,
-			Append:  true,
-		},
-	)
-
-	return nil
-}
+	if cmdline == "" {
+		// without a .cmdline, systemd-stub lets the boot loader pass any cmdline, unless Secure Boot is enabled
+		slog.Warn("No cmdline given, the UKI has no .cmdline section")
 
-func (builder *Builder) generateCmdline() error {
-	slog.Debug("Using cmdline", "cmdline", builder.Cmdline)
-	path := filepath.Join(builder.scratchDir, "cmdline")
-
-	if err := os.WriteFile(path, []byte(builder.Cmdline), 0o600); err != nil {
-		return err
+		return nil
 	}
 
+	slog.Debug("Using cmdline", "cmdline", cmdline)
+
 	builder.sections = append(builder.sections,
 		types.UkiSection{
 			Name:    constants.CMDLine,
-			Path:    path,
+			Data:    []byte(cmdline),
 			Measure: true,
 			Append:  true,
 		},
 	)
-	builder.profileCmdlinePaths = append(builder.profileCmdlinePaths, path)
 
 	return nil
 }
 
 func (builder *Builder) generateInitrd() error {
-	slog.Debug("Using initrd", "path", builder.InitrdPath)
-	builder.sections = append(builder.sections,
-		types.UkiSection{
-			Name:    constants.Initrd,
-			Path:    builder.InitrdPath,
-			Measure: true,
-			Append:  true,
-		},
-	)
-
-	return nil
-}
-
-func (builder *Builder) generateSplash() error {
-	path := filepath.Join(builder.scratchDir, "splash.bmp")
-	var data []byte
-
-	if builder.Splash != "" {
-		slog.Debug("Using splash", "file", builder.Splash)
-		data, _ = os.ReadFile(builder.Splash)
-	} else {
-		slog.Debug("Using generic bundled splash")
-		data = common.Logo
+	extra, err := builder.extraInitrd()
+	if err != nil {
+		return err
 	}
 
-	if err := os.WriteFile(path, data, 0o600); err != nil {
-		return err
+	data := builder.initrdData
+	if extra != nil {
+		data = appendAligned(data[:len(data):len(data)], extra)
 	}
 
+	slog.Debug("Using initrd", "size", len(data))
 	builder.sections = append(builder.sections,
 		types.UkiSection{
-			Name:    constants.Splash,
-			Path:    path,
+			Name:    constants.Initrd,
+			Data:    data,
 			Measure: true,
 			Append:  true,
 		},
@@ -115,12 +72,21 @@ func (builder *Builder) generateSplash() error {
 }
 
 func (builder *Builder) generateUname() error {
+	kernelVersion := builder.Uname
+
 	// it is not always possible to get the kernel version from the kernel image, so we
-	// do a bit of pre-checks
-	var kernelVersion string
+	// fall back to the modules shipped in the initrd
+	if kernelVersion == "" {
+		var err error
+
+		if kernelVersion, err = discoverKernelVersion(builder.kernelData); err != nil {
+			slog.Debug("Could not read kernel version from the kernel", "path", builder.KernelPath, "error", err)
 
-	// otherwise, try to get the kernel version from the kernel image
-	kernelVersion, _ = DiscoverKernelVersion(builder.KernelPath) //nolint:errcheck
+			if kernelVersion, err = initrdKernelVersion(builder.initrdData); err != nil {
+				slog.Debug("Could not read kernel version from the initrd", "error", err)
+			}
+		}
+	}
 
 	if kernelVersion == "" {
 		// we haven't got the kernel version, skip the uname section
@@ -130,16 +96,10 @@ func (builder *Builder) generateUname() error {
 		slog.Debug("Getting uname", "version", kernelVersion, "path", builder.KernelPath)
 	}
 
-	path := filepath.Join(builder.scratchDir, "uname")
-
-	if err := os.WriteFile(path, []byte(kernelVersion), 0o600); err != nil {
-		return err
-	}
-
 	builder.sections = append(builder.sections,
 		types.UkiSection{
 			Name:    constants.Uname,
-			Path:    path,
+			Data:    []byte(kernelVersion),
 			Measure: true,
 			Append:  true,
 		},
@@ -150,27 +110,38 @@ func (builder *Builder) generateUname() error {
 
 func (builder *Builder) generateSBAT() error {
 	slog.Debug("Getting SBAT", "path", builder.SdStubPath)
-	sbat, err := GetSBAT(builder.SdStubPath)
+	stub, err := pe.NewFile(bytes.NewReader(builder.stubData))
 	if err != nil {
 		return err
 	}
 
-	slog.Debug("Generated SBAT", "sbat", sbat, "path", builder.SdStubPath)
-
-	path := filepath.Join(builder.scratchDir, "sbat")
+	defer stub.Close() //nolint:errcheck
 
-	if err = os.WriteFile(path, sbat, 0o600); err != nil {
+	sbat, err := getSBAT(stub)
+	if err != nil {
 		return err
 	}
 
-	// SBAT needs to be measured but NOT added
+	if builder.SBAT != "" {
+		sbat = mergeSBAT(sbat, []byte(builder.SBAT))
+
+		if err = ValidateSBAT(sbat); err != nil {
+			return fmt.Errorf("invalid SBAT: %w", err)
+		}
+	}
+
+	slog.Debug("Generated SBAT", "sbat", sbat, "path", builder.SdStubPath)
+
+	// without extra entries, SBAT needs to be measured but NOT added
 	// This is because we build with the systemd-stub as base, and that already has a .sbat section!
 	// So int he final PE file we will get the .sbat section in there, so we need to measure.
+	// The merged SBAT replaces the one of the sd-stub in place.
 	builder.sections = append(builder.sections,
 		types.UkiSection{
 			Name:    constants.SBAT,
-			Path:    path,
+			Data:    sbat,
 			Measure: true,
+			Append:  builder.SBAT != "",
 		},
 	)
 
@@ -192,16 +163,10 @@ func (builder *Builder) generatePCRPublicKey() error {
 		Bytes: publicKeyBytes,
 	})
 
-	path := filepath.Join(builder.scratchDir, "pcr-public.pem")
-
-	if err = os.WriteFile(path, publicKeyPEM, 0o600); err != nil {
-		return err
-	}
-
 	builder.sections = append(builder.sections,
 		types.UkiSection{
 			Name:    constants.PCRPKey,
-			Path:    path,
+			Data:    publicKeyPEM,
 			Append:  true,
 			Measure: true,
 		},
@@ -217,7 +182,7 @@ func (builder *Builder) generateKernel() error {
 	builder.sections = append(builder.sections,
 		types.UkiSection{
 			Name:    constants.Linux,
-			Path:    builder.KernelPath,
+			Data:    builder.kernelData,
 			Append:  true,
 			Measure: true,
 		},
@@ -227,190 +192,97 @@ func (builder *Builder) generateKernel() error {
 }
 
 func (builder *Builder) generatePCRSig() error {
-	if len(builder.ExtraCmdlines) > 0 {
-		return nil // handled per-profile above
+	if len(builder.Profiles) > 0 || len(builder.ExtraCmdlines) > 0 {
+		// signed for each profile by generateProfiles
+		return nil
 	}
+
 	slog.Info("Generating PCR measurements")
 	slog.Debug("Using PCR slot", "number", constants.UKIPCR)
-	sectionsData := utils.SectionsData(builder.sections)
-
-	// If we have the signer sign the measurements and attach them to the uki file
-	if builder.pcrSignEnabled() {
-		slog.Info("Generating signed policy per profile")
-		// ensure we have at least the base cmdline recorded
-		if len(builder.profileCmdlinePaths) == 0 {
-			slog.Debug("profileCmdlinePaths empty; falling back to current sectionsData .cmdline")
-			builder.profileCmdlinePaths = append(builder.profileCmdlinePaths, sectionsData[constants.CMDLine])
-		}
-		for i, cmd := range builder.profileCmdlinePaths {
-			// clone & override the cmdline for this profile
-			override := map[constants.Section]string{}
-			for k, v := range sectionsData {
-				override[k] = v
-			}
-			override[constants.CMDLine] = cmd
-
-			pcrData, err := measure.GenerateSignedPCR(override, builder.Phases, builder.PCRSigner, constants.UKIPCR)
-			if err != nil {
-				return err
-			}
-			pcrSignatureData, err := json.Marshal(pcrData)
-			if err != nil {
-				return err
-			}
-			path := filepath.Join(builder.scratchDir, fmt.Sprintf("pcrpsig-%d", i))
-			if err = os.WriteFile(path, pcrSignatureData, 0o600); err != nil {
-				return err
-			}
-			builder.sections = append(builder.sections,
-				types.UkiSection{
-					Name:   constants.PCRSig,
-					Path:   path,
-					Append: true,
-				},
-			)
-		}
-	} else {
-		// For visibility, print measurements for the base and extras
-		if len(builder.profileCmdlinePaths) == 0 {
-			measure.GenerateMeasurements(sectionsData, builder.Phases, constants.UKIPCR)
-		} else {
-			for _, cmd := range builder.profileCmdlinePaths {
-				override := map[constants.Section]string{}
-				for k, v := range sectionsData {
-					override[k] = v
-				}
-				override[constants.CMDLine] = cmd
-				measure.GenerateMeasurements(override, builder.Phases, constants.UKIPCR)
-			}
-		}
+	sectionsContent, err := utils.SectionsContent(builder.sections)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	// If we have the signer sign the measurements and attach them to the uki file
+	if !builder.pcrSignEnabled() {
+		builder.printMeasurements(sectionsContent)
 
-// generateBaseProfileAndSig emits a minimal base .profile and a .pcrsig
-// signed over the shared sections + BASE cmdline when extra profiles are used.
-// If there are no ExtraCmdlines, it does nothing (single-profile flow).
-func (builder *Builder) generateBaseProfileAndSig() error {
-	if len(builder.ExtraCmdlines) == 0 {
-		// single-profile: handled later by generatePCRSig()
 		return nil
 	}
 
-	// 1) .profile (base)
-	profPath := filepath.Join(builder.scratchDir, "profile-base")
-	// Minimal body so bootctl shows something nice
-	body := []byte(fmt.Sprintf("ID=profile-0\nTITLE=%s\n", builder.Cmdline))
-	if err := os.WriteFile(profPath, body, 0o600); err != nil {
+	pcrSignatureData, err := builder.signPCR(sectionsContent)
+	if err != nil {
 		return err
 	}
-	builder.sections = append(builder.sections, types.UkiSection{
-		Name:   constants.Profile,
-		Path:   profPath,
-		Append: true,
-		// not measured
-	})
 
-	// 2) .pcrsig (base) — sign over current sections with BASE cmdline
-	if !builder.pcrSignEnabled() {
-		// no signing: measurements will be printed later
-		return nil
-	}
+	builder.sections = append(builder.sections,
+		types.UkiSection{
+			Name:   constants.PCRSig,
+			Data:   pcrSignatureData,
+			Append: true,
+		},
+	)
 
-	// Build map of measured sections and force base cmdline
-	sectionsData := utils.SectionsData(builder.sections)
-	baseCmd := sectionsData[constants.CMDLine]
-	if len(builder.profileCmdlinePaths) > 0 && builder.profileCmdlinePaths[0] != "" {
-		baseCmd = builder.profileCmdlinePaths[0]
-	}
-	override := map[constants.Section]string{}
-	for k, v := range sectionsData {
-		override[k] = v
-	}
-	override[constants.CMDLine] = baseCmd
+	return nil
+}
 
-	slog.Info("Generating signed PCR policy (base profile)")
-	pcrData, err := measure.GenerateSignedPCR(override, builder.Phases, builder.PCRSigner, constants.UKIPCR)
-	if err != nil {
-		return err
-	}
-	pcrJSON, err := json.Marshal(pcrData)
+// signPCR signs the PCR policies for the measured sections, and returns them as the .pcrsig JSON.
+//
+// systemd-stub only measures the .dtbauto section it picks, so there is a policy for each of
+// them, and for boards none of them matches.
+func (builder *Builder) signPCR(sectionsContent measure.SectionsContent) ([]byte, error) {
+	pcrValues, err := builder.policyPCRValues()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	sigPath := filepath.Join(builder.scratchDir, "pcrpsig-base")
-	if err := os.WriteFile(sigPath, pcrJSON, 0o600); err != nil {
-		return err
+
+	pcrData := &types.PCRData{}
+
+	for _, variant := range builder.dtbAutoVariants(sectionsContent) {
+		variantData, err := measure.GenerateSignedPolicyForContent(variant, builder.Phases, builder.PCRSigner, constants.UKIPCR, pcrValues)
+		if err != nil {
+			return nil, err
+		}
+
+		pcrData.Append(variantData)
 	}
-	builder.sections = append(builder.sections, types.UkiSection{
-		Name:   constants.PCRSig,
-		Path:   sigPath,
-		Append: true,
-	})
-	return nil
+
+	return json.Marshal(pcrData)
 }
 
-func (builder *Builder) generateExtraProfiles() error {
-	if len(builder.ExtraCmdlines) == 0 {
-		return nil
+// printMeasurements prints the PCR measurements for the measured sections, see signPCR.
+func (builder *Builder) printMeasurements(sectionsContent measure.SectionsContent) {
+	for _, variant := range builder.dtbAutoVariants(sectionsContent) {
+		measure.GenerateMeasurementsForContent(variant, builder.Phases, constants.UKIPCR)
 	}
+}
 
-	for i, line := range builder.ExtraCmdlines {
-		// 1) .profile (extra i+1)
-		profPath := filepath.Join(builder.scratchDir, fmt.Sprintf("profile-%d", i+1))
-		// Keep TITLE simple; adjust if you later add a separate --extra-title
-		profBody := []byte(fmt.Sprintf("ID=profile-%d\nTITLE=%s\n", i+1, line))
-		if err := os.WriteFile(profPath, profBody, 0o600); err != nil {
-			return err
+// dtbAutoVariants returns the measured sections as seen by systemd-stub for each .dtbauto section
+// it may pick, and for none of them.
+func (builder *Builder) dtbAutoVariants(sectionsContent measure.SectionsContent) []measure.SectionsContent {
+	noMatch := measure.SectionsContent{}
+	for k, v := range sectionsContent {
+		if k != constants.DTBAuto {
+			noMatch[k] = v
 		}
-		builder.sections = append(builder.sections, types.UkiSection{
-			Name:   constants.Profile,
-			Path:   profPath,
-			Append: true,
-		})
+	}
 
-		// 2) .cmdline for this profile
-		cmdPath := filepath.Join(builder.scratchDir, fmt.Sprintf("cmdline-extra-%d", i+1))
-		if err := os.WriteFile(cmdPath, []byte(line), 0o600); err != nil {
-			return err
+	variants := []measure.SectionsContent{noMatch}
+
+	for _, section := range builder.sections {
+		if section.Name != constants.DTBAuto {
+			continue
 		}
-		builder.sections = append(builder.sections, types.UkiSection{
-			Name:    constants.CMDLine,
-			Path:    cmdPath,
-			Measure: true,
-			Append:  true,
-		})
-		builder.profileCmdlinePaths = append(builder.profileCmdlinePaths, cmdPath)
-
-		// 3) .pcrsig for this profile
-		if builder.pcrSignEnabled() {
-			sectionsData := utils.SectionsData(builder.sections)
-			override := map[constants.Section]string{}
-			for k, v := range sectionsData {
-				override[k] = v
-			}
-			override[constants.CMDLine] = cmdPath
 
-			slog.Info("Generating signed PCR policy", "profile", i+1)
-			pcrData, err := measure.GenerateSignedPCR(override, builder.Phases, builder.PCRSigner, constants.UKIPCR)
-			if err != nil {
-				return err
-			}
-			pcrJSON, err := json.Marshal(pcrData)
-			if err != nil {
-				return err
-			}
-			sigPath := filepath.Join(builder.scratchDir, fmt.Sprintf("pcrpsig-%d", i+1))
-			if err := os.WriteFile(sigPath, pcrJSON, 0o600); err != nil {
-				return err
-			}
-			builder.sections = append(builder.sections, types.UkiSection{
-				Name:   constants.PCRSig,
-				Path:   sigPath,
-				Append: true,
-			})
+		variant := measure.SectionsContent{}
+		for k, v := range noMatch {
+			variant[k] = v
 		}
+		variant[constants.DTBAuto] = section.Data
+
+		variants = append(variants, variant)
 	}
-	return nil
+
+	return variants
 }
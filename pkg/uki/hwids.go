@@ -0,0 +1,226 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// HWID maps the hardware IDs of a board to the devicetree it boots with, for the .hwids section.
+//
+// The JSON form is the one of the hwids description files of systemd's ukify.
+type HWID struct {
+	// Type of the entry, only "devicetree" is supported. Empty means devicetree.
+	Type string `json:"type,omitempty"`
+	// Name of the board.
+	Name string `json:"name"`
+	// Compatible of the devicetree, matched against the root compatible of the .dtbauto sections.
+	Compatible string `json:"compatible"`
+	// CHIDs of the board, as computed from its SMBIOS data by fwupdtool hwids or systemd-analyze chid.
+	CHIDs []string `json:"hwids"`
+}
+
+// hwidDevicetree is the type of .hwids entries which select a devicetree, from systemd's src/boot/chid.h.
+const hwidDevicetree = 1
+
+// hwidEntrySize is the size of a .hwids entry: descriptor, CHID, name and compatible offsets.
+const hwidEntrySize = 4 + 16 + 4 + 4
+
+// LoadHWIDs reads the hwids description files (*.json) found in dir.
+func LoadHWIDs(dir string) ([]HWID, error) {
+	var hwids []HWID
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var hwid HWID
+		if err = json.Unmarshal(data, &hwid); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if err = hwid.validate(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		hwids = append(hwids, hwid)
+
+		return nil
+	})
+
+	return hwids, err
+}
+
+// validate checks the entry can be encoded in the .hwids section.
+func (hwid HWID) validate() error {
+	if hwid.Type != "" && hwid.Type != "devicetree" {
+		return fmt.Errorf("unsupported hwid type %q", hwid.Type)
+	}
+
+	if hwid.Name == "" || hwid.Compatible == "" {
+		return errors.New("hwid needs both a name and a compatible")
+	}
+
+	if len(hwid.CHIDs) == 0 {
+		return fmt.Errorf("hwid %s has no hwids", hwid.Name)
+	}
+
+	for _, chid := range hwid.CHIDs {
+		if _, err := parseGUID(chid); err != nil {
+			return fmt.Errorf("hwid %s: %w", hwid.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// encodeHWIDs builds the .hwids section: a table of entries terminated by an empty one, followed
+// by the NUL terminated strings the entries point to, with offsets from the start of the section.
+func encodeHWIDs(hwids []HWID) ([]byte, error) {
+	var stringTable bytes.Buffer
+
+	count := 0
+	for _, hwid := range hwids {
+		count += len(hwid.CHIDs)
+	}
+
+	tableSize := (count + 1) * hwidEntrySize
+	offsets := map[string]uint32{}
+
+	stringOffset := func(s string) uint32 {
+		if offset, ok := offsets[s]; ok {
+			return offset
+		}
+
+		offsets[s] = uint32(tableSize + stringTable.Len())
+		stringTable.WriteString(s)
+		stringTable.WriteByte(0)
+
+		return offsets[s]
+	}
+
+	entries := make([]byte, 0, tableSize)
+
+	for _, hwid := range hwids {
+		if err := hwid.validate(); err != nil {
+			return nil, err
+		}
+
+		name, compatible := stringOffset(hwid.Name), stringOffset(hwid.Compatible)
+
+		for _, chid := range hwid.CHIDs {
+			guid, err := parseGUID(chid)
+			if err != nil {
+				return nil, err
+			}
+
+			// the highest four bits of the descriptor are the type, the others the size of the entry
+			entries = binary.LittleEndian.AppendUint32(entries, hwidDevicetree<<28|hwidEntrySize)
+			entries = append(entries, guid...)
+			entries = binary.LittleEndian.AppendUint32(entries, name)
+			entries = binary.LittleEndian.AppendUint32(entries, compatible)
+		}
+	}
+
+	// the table ends with an empty entry
+	entries = append(entries, make([]byte, hwidEntrySize)...)
+
+	return append(entries, stringTable.Bytes()...), nil
+}
+
+// parseGUID parses a GUID in its string form into its mixed-endian binary form.
+func parseGUID(s string) ([]byte, error) {
+	guid, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(guid) != 16 || len(s) != 36 {
+		return nil, fmt.Errorf("invalid GUID %q", s)
+	}
+
+	// the first three fields are little endian
+	slices.Reverse(guid[0:4])
+	slices.Reverse(guid[4:6])
+	slices.Reverse(guid[6:8])
+
+	return guid, nil
+}
+
+// generateDTBAuto appends a .dtbauto section per devicetree, in order, as systemd-stub picks the
+// first one which matches the board.
+func (builder *Builder) generateDTBAuto() error {
+	for _, path := range builder.DevicetreeAutoPaths {
+		data, err := readDTB(path)
+		if err != nil {
+			return err
+		}
+
+		compatible, err := dtbCompatible(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		slog.Debug("Using automatically selected devicetree", "path", path, "compatible", compatible)
+
+		builder.sections = append(builder.sections,
+			types.UkiSection{
+				Name:    constants.DTBAuto,
+				Data:    data,
+				Measure: true,
+				Append:  true,
+			},
+		)
+		builder.dtbAutoCompatibles = append(builder.dtbAutoCompatibles, compatible...)
+	}
+
+	return nil
+}
+
+// generateHWIDs appends the .hwids section, which lets systemd-stub pick the .dtbauto section
+// from the SMBIOS data of boards that do not provide a devicetree.
+func (builder *Builder) generateHWIDs() error {
+	if len(builder.HWIDs) == 0 {
+		return nil
+	}
+
+	for _, hwid := range builder.HWIDs {
+		if !slices.Contains(builder.dtbAutoCompatibles, hwid.Compatible) {
+			return fmt.Errorf("hwid %s is for compatible %s, which none of the automatically selected devicetrees is", hwid.Name, hwid.Compatible)
+		}
+	}
+
+	data, err := encodeHWIDs(builder.HWIDs)
+	if err != nil {
+		return err
+	}
+
+	builder.sections = append(builder.sections,
+		types.UkiSection{
+			Name:    constants.HWIDs,
+			Data:    data,
+			Measure: true,
+			Append:  true,
+		},
+	)
+
+	return nil
+}
@@ -6,39 +6,58 @@ package uki
 
 import (
 	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"debug/pe"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"slices"
 	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/klauspost/compress/zstd"
 )
 
 // DiscoverKernelVersion reads kernel version from the kernel image.
 //
-// This only works for x86 kernel images.
-//
-// Based on https://www.kernel.org/doc/html/v5.6/x86/boot.html.
+// x86 kernel images point to the version string from their setup header, based on
+// https://www.kernel.org/doc/html/v5.6/x86/boot.html. EFI zboot images are decompressed first.
+// For other uncompressed images, like arm64 or riscv64 Image files and ELF vmlinux files, the
+// version is taken from the Linux banner in the kernel.
 func DiscoverKernelVersion(kernelPath string) (string, error) {
-	f, err := os.Open(kernelPath)
+	data, err := os.ReadFile(kernelPath)
 	if err != nil {
 		return "", err
 	}
 
-	defer f.Close() //nolint:errcheck
+	return discoverKernelVersion(data)
+}
 
-	header := make([]byte, 1024)
+// discoverKernelVersion reads kernel version from the kernel image in data, see DiscoverKernelVersion.
+func discoverKernelVersion(data []byte) (string, error) {
+	if isZboot(data) {
+		payload, err := zbootPayload(data)
+		if err != nil {
+			return "", err
+		}
 
-	_, err = f.Read(header)
-	if err != nil {
-		return "", err
+		return discoverKernelVersion(payload)
+	}
+
+	if bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return elfKernelVersion(data)
 	}
 
 	// check header magic
-	if string(header[0x202:0x206]) != "HdrS" {
-		return "", errors.New("invalid kernel image")
+	if len(data) < 0x210 || string(data[0x202:0x206]) != "HdrS" {
+		return bannerKernelVersion(data)
 	}
 
-	setupSects := header[0x1f1]
-	versionOffset := binary.LittleEndian.Uint16(header[0x20e:0x210])
+	setupSects := data[0x1f1]
+	versionOffset := binary.LittleEndian.Uint16(data[0x20e:0x210])
 
 	if versionOffset == 0 {
 		return "", errors.New("no kernel version")
@@ -48,15 +67,13 @@ func DiscoverKernelVersion(kernelPath string) (string, error) {
 		return "", errors.New("invalid kernel version offset")
 	}
 
-	versionOffset += 0x200
-
-	version := make([]byte, 256)
-
-	_, err = f.ReadAt(version, int64(versionOffset))
-	if err != nil {
-		return "", err
+	start := int(versionOffset) + 0x200
+	if start >= len(data) {
+		return "", errors.New("invalid kernel version offset")
 	}
 
+	version := data[start:min(start+256, len(data))]
+
 	idx := bytes.IndexByte(version, 0)
 	if idx == -1 {
 		return "", errors.New("invalid kernel version")
@@ -67,3 +84,169 @@ func DiscoverKernelVersion(kernelPath string) (string, error) {
 
 	return versionString, nil
 }
+
+// linuxBanner is the start of the banner the kernel prints on boot, followed by its version.
+const linuxBanner = "Linux version "
+
+// bannerKernelVersion finds the kernel version in the Linux banner of an uncompressed kernel.
+func bannerKernelVersion(data []byte) (string, error) {
+	for {
+		idx := bytes.Index(data, []byte(linuxBanner))
+		if idx == -1 {
+			return "", errors.New("no kernel version")
+		}
+
+		data = data[idx+len(linuxBanner):]
+
+		// skip format strings and other mentions of the banner which are not followed by a version
+		version, _, _ := bytes.Cut(data[:min(len(data), 256)], []byte(" "))
+		if len(version) > 0 && version[0] >= '0' && version[0] <= '9' {
+			return string(version), nil
+		}
+	}
+}
+
+// elfKernelVersion finds the kernel version in the Linux banner of a vmlinux ELF file, which is
+// part of its read-only data.
+func elfKernelVersion(data []byte) (string, error) {
+	elfFile, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	defer elfFile.Close() //nolint:errcheck
+
+	if rodata := elfFile.Section(".rodata"); rodata != nil && rodata.Type != elf.SHT_NOBITS {
+		if content, err := rodata.Data(); err == nil {
+			if version, err := bannerKernelVersion(content); err == nil {
+				return version, nil
+			}
+		}
+	}
+
+	return bannerKernelVersion(data)
+}
+
+// EFI zboot header, based on drivers/firmware/efi/libstub/zboot-header.S of the kernel.
+const (
+	zbootMagic             = "zimg"
+	zbootHeaderSize        = 0x40
+	zbootCompressionOffset = 0x18
+	zbootCompressionSize   = 32
+)
+
+// isZboot reports whether data is an EFI zboot image, a PE file wrapping a compressed kernel.
+func isZboot(data []byte) bool {
+	return len(data) >= zbootHeaderSize && string(data[0:2]) == "MZ" && string(data[4:8]) == zbootMagic
+}
+
+// zbootPayload decompresses the kernel of an EFI zboot image.
+func zbootPayload(data []byte) ([]byte, error) {
+	offset := binary.LittleEndian.Uint32(data[8:])
+	size := binary.LittleEndian.Uint32(data[12:])
+
+	if uint64(offset)+uint64(size) > uint64(len(data)) {
+		return nil, errors.New("zboot payload extends past the kernel image")
+	}
+
+	payload := data[offset : offset+size]
+
+	compression, _, _ := bytes.Cut(data[zbootCompressionOffset:zbootCompressionOffset+zbootCompressionSize], []byte{0})
+
+	switch string(compression) {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(zr)
+	case "zstd", "zstd22":
+		zr, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		defer zr.Close()
+
+		return zr.DecodeAll(payload, nil)
+	default:
+		return nil, fmt.Errorf("unsupported zboot compression %q", compression)
+	}
+}
+
+// initrdKernelVersion finds the kernel version from the lib/modules/<version> directory of the initrd.
+func initrdKernelVersion(data []byte) (string, error) {
+	names, err := initrd.List(data)
+	if err != nil {
+		return "", err
+	}
+
+	var versions []string
+
+	for _, name := range names {
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "./"), "/")
+		name = strings.TrimPrefix(name, "usr/")
+
+		rest, ok := strings.CutPrefix(name, "lib/modules/")
+		if !ok {
+			continue
+		}
+
+		version, _, _ := strings.Cut(rest, "/")
+		if version != "" && version[0] >= '0' && version[0] <= '9' && !slices.Contains(versions, version) {
+			versions = append(versions, version)
+		}
+	}
+
+	switch len(versions) {
+	case 0:
+		return "", errors.New("no kernel modules in the initrd")
+	case 1:
+		return versions[0], nil
+	default:
+		return "", fmt.Errorf("initrd has modules for several kernel versions: %s", strings.Join(versions, ", "))
+	}
+}
+
+// xlfEFIHandover32 is the x86 boot protocol xloadflags bit advertising the 32-bit EFI handover entry.
+//
+// Based on https://www.kernel.org/doc/html/latest/arch/x86/boot.html.
+const xlfEFIHandover32 = 1 << 2
+
+// CheckKernelIA32Entry checks that the kernel image can be started by a 32-bit (ia32) sd-stub.
+//
+// The kernel needs to either advertise the 32-bit EFI handover protocol, or ship the
+// .compat PE section which describes its mixed mode entry point.
+func CheckKernelIA32Entry(kernelPath string) error {
+	data, err := os.ReadFile(kernelPath)
+	if err != nil {
+		return err
+	}
+
+	return checkKernelIA32Entry(data)
+}
+
+// checkKernelIA32Entry checks the kernel image in data, see CheckKernelIA32Entry.
+func checkKernelIA32Entry(data []byte) error {
+	if len(data) < 0x238 || string(data[0x202:0x206]) != "HdrS" {
+		return errors.New("kernel is not an x86 bzImage")
+	}
+
+	// xloadflags were introduced with boot protocol 2.12
+	if binary.LittleEndian.Uint16(data[0x206:0x208]) >= 0x020c {
+		if binary.LittleEndian.Uint16(data[0x236:0x238])&xlfEFIHandover32 != 0 {
+			return nil
+		}
+	}
+
+	if peFile, err := pe.NewFile(bytes.NewReader(data)); err == nil {
+		defer peFile.Close() //nolint:errcheck
+
+		if peFile.Section(".compat") != nil {
+			return nil
+		}
+	}
+
+	return errors.New("kernel has neither a 32-bit EFI handover entry nor a .compat section")
+}
@@ -0,0 +1,273 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"debug/pe"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// LintSeverity tells how bad a LintIssue is.
+type LintSeverity string
+
+const (
+	// LintWarning is an issue that does not prevent the UKI from booting, but is likely a mistake.
+	LintWarning LintSeverity = "warning"
+	// LintError is an issue that prevents systemd-stub from booting the UKI as intended.
+	LintError LintSeverity = "error"
+)
+
+// LintIssue is a problem found in a UKI by Lint.
+type LintIssue struct {
+	Severity LintSeverity
+	// Section the issue was found in, empty for issues with the whole file.
+	Section string
+	Message string
+}
+
+// String returns the issue in a human readable form.
+func (issue LintIssue) String() string {
+	if issue.Section == "" {
+		return fmt.Sprintf("%s: %s", issue.Severity, issue.Message)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", issue.Severity, issue.Section, issue.Message)
+}
+
+// Lint checks the structure of the UKI at path against what systemd-stub expects.
+//
+// An error is only returned if the file cannot be parsed as a PE file, problems with
+// the UKI itself are returned as issues.
+func Lint(path string) ([]LintIssue, error) {
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer peFile.Close() //nolint:errcheck
+
+	l := &linter{file: peFile}
+
+	switch header := peFile.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		l.sectionAlignment, l.fileAlignment, l.sizeOfImage = header.SectionAlignment, header.FileAlignment, header.SizeOfImage
+	case *pe.OptionalHeader64:
+		l.sectionAlignment, l.fileAlignment, l.sizeOfImage = header.SectionAlignment, header.FileAlignment, header.SizeOfImage
+	default:
+		return nil, errors.New("failed to get optional header")
+	}
+
+	l.checkLayout()
+	l.checkFlags()
+	l.checkSections()
+	l.checkProfiles()
+	l.checkSBAT()
+
+	return l.issues, nil
+}
+
+// linter collects the issues found in a UKI.
+type linter struct {
+	file   *pe.File
+	issues []LintIssue
+
+	sectionAlignment uint32
+	fileAlignment    uint32
+	sizeOfImage      uint32
+}
+
+func (l *linter) report(severity LintSeverity, section string, format string, args ...any) {
+	l.issues = append(l.issues, LintIssue{
+		Severity: severity,
+		Section:  section,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkLayout checks the sections are aligned, don't overlap and fit in the image.
+func (l *linter) checkLayout() {
+	if !isPowerOfTwo(l.sectionAlignment) || !isPowerOfTwo(l.fileAlignment) {
+		l.report(LintError, "", "invalid alignment: SectionAlignment 0x%x, FileAlignment 0x%x", l.sectionAlignment, l.fileAlignment)
+
+		return
+	}
+
+	for i, section := range l.file.Sections {
+		if section.VirtualAddress%l.sectionAlignment != 0 {
+			l.report(LintError, section.Name, "virtual address 0x%x is not aligned to SectionAlignment 0x%x", section.VirtualAddress, l.sectionAlignment)
+		}
+
+		if section.Size != 0 && (section.Offset%l.fileAlignment != 0 || section.Size%l.fileAlignment != 0) {
+			l.report(LintError, section.Name, "raw data at 0x%x (0x%x bytes) is not aligned to FileAlignment 0x%x", section.Offset, section.Size, l.fileAlignment)
+		}
+
+		end := uint64(section.VirtualAddress) + uint64(max(section.VirtualSize, 1))
+		if end > uint64(l.sizeOfImage) {
+			l.report(LintError, section.Name, "ends at 0x%x, past SizeOfImage 0x%x", end, l.sizeOfImage)
+		}
+
+		for _, other := range l.file.Sections[i+1:] {
+			otherEnd := uint64(other.VirtualAddress) + uint64(max(other.VirtualSize, 1))
+			if uint64(section.VirtualAddress) < otherEnd && uint64(other.VirtualAddress) < end {
+				l.report(LintError, section.Name, "overlaps in memory with section %s", other.Name)
+			}
+
+			if section.Size != 0 && other.Size != 0 && section.Offset < other.Offset+other.Size && other.Offset < section.Offset+section.Size {
+				l.report(LintError, section.Name, "overlaps in the file with section %s", other.Name)
+			}
+		}
+	}
+}
+
+// checkFlags checks the UKI sections have the flags the builder sets on them.
+func (l *linter) checkFlags() {
+	for _, section := range l.file.Sections {
+		name := constants.Section(section.Name)
+
+		// .sbat comes from the sd-stub itself
+		if name == constants.SBAT || !slices.Contains(constants.UKISections(), name) {
+			continue
+		}
+
+		if section.Characteristics&pe.IMAGE_SCN_MEM_READ == 0 {
+			l.report(LintError, section.Name, "is not readable")
+		}
+
+		if section.Characteristics&pe.IMAGE_SCN_MEM_WRITE != 0 {
+			l.report(LintError, section.Name, "is writable")
+		}
+
+		contents, kind := uint32(pe.IMAGE_SCN_CNT_INITIALIZED_DATA), "data"
+		if name == constants.Linux {
+			contents, kind = pe.IMAGE_SCN_CNT_CODE, "code"
+		}
+
+		if section.Characteristics&contents == 0 {
+			l.report(LintError, section.Name, "has flags 0x%x, expected it to be marked as %s", section.Characteristics, kind)
+		}
+	}
+}
+
+// checkSections checks the required sections are there and .linux comes last.
+func (l *linter) checkSections() {
+	base := l.parts()[0]
+
+	linux := slices.IndexFunc(base, func(section *pe.Section) bool { return section.Name == string(constants.Linux) })
+	if linux == -1 {
+		l.report(LintError, "", "missing %s section", constants.Linux)
+	} else {
+		// the kernel might be decompressed in place, so nothing but the signature may follow it
+		for _, section := range base[linux+1:] {
+			if section.Name != string(constants.PCRSig) {
+				l.report(LintError, section.Name, "comes after the %s section, which must be last", constants.Linux)
+			}
+		}
+	}
+
+	for _, recommended := range []struct {
+		section constants.Section
+		warning string
+	}{
+		{constants.OSRel, "sd-boot will not list the UKI"},
+		{constants.CMDLine, "the boot loader can supply the kernel command line"},
+		{constants.SBAT, "shim will refuse to boot the UKI"},
+	} {
+		if l.file.Section(string(recommended.section)) == nil {
+			l.report(LintWarning, "", "missing %s section, %s", recommended.section, recommended.warning)
+		}
+	}
+}
+
+// checkProfiles checks each profile has its sections at most once, and that .pcrsig is paired with every profile.
+func (l *linter) checkProfiles() {
+	parts := l.parts()
+
+	for i, part := range parts {
+		seen := map[string]bool{}
+
+		for _, section := range part {
+			if seen[section.Name] && section.Name != string(constants.DTBAuto) && slices.Contains(constants.UKISections(), constants.Section(section.Name)) {
+				l.report(LintError, section.Name, "appears more than once in %s", partName(i))
+			}
+
+			seen[section.Name] = true
+		}
+	}
+
+	if len(parts) == 1 {
+		return
+	}
+
+	signed := 0
+
+	for _, part := range parts[1:] {
+		if containsSection(part, constants.PCRSig) {
+			signed++
+		}
+	}
+
+	if signed != 0 && signed != len(parts)-1 {
+		for i, part := range parts[1:] {
+			if !containsSection(part, constants.PCRSig) {
+				l.report(LintError, "", "%s has no %s section, while other profiles do", partName(i+1), constants.PCRSig)
+			}
+		}
+	}
+
+	if containsSection(parts[0], constants.PCRSig) {
+		l.report(LintWarning, string(constants.PCRSig), "is shared by all profiles, but it cannot match the measurement of their %s sections", constants.Profile)
+	}
+}
+
+// checkSBAT checks the .sbat section is a well formed SBAT CSV.
+func (l *linter) checkSBAT() {
+	content, err := sectionContent(l.file, string(constants.SBAT))
+	if err != nil {
+		l.report(LintError, string(constants.SBAT), "cannot be read: %s", err)
+
+		return
+	}
+
+	if content == nil {
+		return
+	}
+
+	if err = ValidateSBAT(content); err != nil {
+		l.report(LintError, string(constants.SBAT), "%s", err)
+	}
+}
+
+// parts splits the sections into the base part, and one part per .profile section.
+func (l *linter) parts() [][]*pe.Section {
+	parts := [][]*pe.Section{nil}
+
+	for _, section := range l.file.Sections {
+		if section.Name == string(constants.Profile) {
+			parts = append(parts, nil)
+		}
+
+		parts[len(parts)-1] = append(parts[len(parts)-1], section)
+	}
+
+	return parts
+}
+
+// containsSection reports whether the named section is part of sections.
+func containsSection(sections []*pe.Section, name constants.Section) bool {
+	return slices.ContainsFunc(sections, func(section *pe.Section) bool { return section.Name == string(name) })
+}
+
+// partName returns the human readable name of a part returned by parts.
+func partName(i int) string {
+	if i == 0 {
+		return "the base sections"
+	}
+
+	return fmt.Sprintf("profile %d", i-1)
+}
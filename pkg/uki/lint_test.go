@@ -0,0 +1,116 @@
+package uki
+
+import (
+	"debug/pe"
+	"os"
+	"path/filepath"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lint", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "uki")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).ToNot(HaveOccurred())
+	})
+
+	// writeUKI appends the named sections to a test PE image, using the flags the builder would set.
+	writeUKI := func(names ...constants.Section) string {
+		img, err := newPEImage(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64))
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, name := range names {
+			content := []byte("content")
+			if name == constants.SBAT {
+				content = []byte("sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\n")
+			}
+
+			_, err = img.appendSection(string(name), content, sectionCharacteristics(name))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		data, err := img.Bytes()
+		Expect(err).ToNot(HaveOccurred())
+
+		path := filepath.Join(tmpDir, "uki.efi")
+		Expect(os.WriteFile(path, data, 0o600)).To(Succeed())
+
+		return path
+	}
+
+	It("Accepts a well formed UKI", func() {
+		issues, err := Lint(writeUKI(constants.SBAT, constants.OSRel, constants.CMDLine, constants.Initrd, constants.Linux, constants.PCRSig))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(issues).To(BeEmpty())
+	})
+
+	It("Accepts a well formed multi-profile UKI", func() {
+		issues, err := Lint(writeUKI(constants.SBAT, constants.OSRel, constants.CMDLine, constants.Linux,
+			constants.Profile, constants.PCRSig,
+			constants.Profile, constants.CMDLine, constants.PCRSig))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(issues).To(BeEmpty())
+	})
+
+	It("Reports sections after .linux", func() {
+		issues, err := Lint(writeUKI(constants.SBAT, constants.OSRel, constants.Linux, constants.CMDLine))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(issues).To(ContainElement(LintIssue{Severity: LintError, Section: ".cmdline", Message: "comes after the .linux section, which must be last"}))
+	})
+
+	It("Reports missing sections", func() {
+		issues, err := Lint(writeUKI(constants.CMDLine))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(issues).To(ContainElement(LintIssue{Severity: LintError, Message: "missing .linux section"}))
+		Expect(issues).To(ContainElement(HaveField("Severity", LintWarning)))
+	})
+
+	It("Reports profiles without a .pcrsig", func() {
+		issues, err := Lint(writeUKI(constants.SBAT, constants.OSRel, constants.CMDLine, constants.Linux,
+			constants.Profile, constants.PCRSig,
+			constants.Profile, constants.CMDLine, constants.CMDLine))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(issues).To(ContainElement(LintIssue{Severity: LintError, Message: "profile 1 has no .pcrsig section, while other profiles do"}))
+		Expect(issues).To(ContainElement(LintIssue{Severity: LintError, Section: ".cmdline", Message: "appears more than once in profile 1"}))
+	})
+
+	It("Reports wrong section flags", func() {
+		img, err := newPEImage(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = img.appendSection(string(constants.Linux), []byte("kernel"), pe.IMAGE_SCN_CNT_INITIALIZED_DATA|pe.IMAGE_SCN_MEM_READ|pe.IMAGE_SCN_MEM_WRITE)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := img.Bytes()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(tmpDir, "uki.efi"), data, 0o600)).To(Succeed())
+
+		issues, err := Lint(filepath.Join(tmpDir, "uki.efi"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(issues).To(ContainElement(LintIssue{Severity: LintError, Section: ".linux", Message: "is writable"}))
+		Expect(issues).To(ContainElement(HaveField("Message", ContainSubstring("expected it to be marked as code"))))
+	})
+
+	Describe("ValidateSBAT", func() {
+		It("Accepts the sd-stub SBAT", func() {
+			sbat, err := GetSBAT("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ValidateSBAT(sbat)).To(Succeed())
+		})
+
+		It("Rejects malformed SBAT", func() {
+			Expect(ValidateSBAT([]byte(""))).ToNot(Succeed())
+			Expect(ValidateSBAT([]byte("kairos,1,Kairos,kairos,1,https://kairos.io\n"))).To(MatchError(ContainSubstring("sbat version line")))
+			Expect(ValidateSBAT([]byte("sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md\nkairos,one,Kairos,kairos,1,https://kairos.io\n"))).To(MatchError(ContainSubstring("invalid generation")))
+			Expect(ValidateSBAT([]byte("sbat,1\n"))).To(MatchError(ContainSubstring("at least 6")))
+		})
+	})
+})
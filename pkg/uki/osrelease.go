@@ -0,0 +1,249 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// os-release syntax, based on https://www.freedesktop.org/software/systemd/man/latest/os-release.html.
+var (
+	osReleaseKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// osReleaseIDRegexp matches the fields which are lower case identifiers.
+	osReleaseIDRegexp = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	// osReleaseIDInvalidRegexp matches the characters lower case identifiers may not have.
+	osReleaseIDInvalidRegexp = regexp.MustCompile(`[^a-z0-9._-]`)
+	// osReleaseUnquotedRegexp matches the values which can be written without quotes.
+	osReleaseUnquotedRegexp = regexp.MustCompile(`^[A-Za-z0-9._+:/-]*$`)
+)
+
+// osReleaseIDFields are the fields restricted to lower case identifiers.
+var osReleaseIDFields = []string{"ID", "VERSION_ID", "VARIANT_ID", "IMAGE_ID", "IMAGE_VERSION", "SYSEXT_LEVEL"}
+
+// osReleaseField is a KEY=VALUE assignment of an os-release file, with its value unquoted.
+type osReleaseField struct {
+	key   string
+	value string
+}
+
+// parseOSReleaseLine parses a line of an os-release file, returning ok false for empty lines and comments.
+func parseOSReleaseLine(line string) (osReleaseField, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return osReleaseField{}, false, nil
+	}
+
+	key, raw, found := strings.Cut(line, "=")
+	if !found || !osReleaseKeyRegexp.MatchString(key) {
+		return osReleaseField{}, false, fmt.Errorf("invalid os-release line %q, expected KEY=VALUE", line)
+	}
+
+	field := osReleaseField{key: key}
+
+	switch {
+	case len(raw) > 0 && raw[0] == '\'':
+		value, found := strings.CutSuffix(raw[1:], "'")
+		if !found || strings.Contains(value, "'") {
+			return osReleaseField{}, false, fmt.Errorf("os-release field %s has an unterminated single quoted value", key)
+		}
+
+		field.value = value
+	case len(raw) > 0 && raw[0] == '"':
+		var value strings.Builder
+
+		escaped, closed := false, false
+
+		for _, c := range raw[1:] {
+			switch {
+			case closed:
+				return osReleaseField{}, false, fmt.Errorf("os-release field %s has trailing characters after its quoted value", key)
+			case escaped:
+				value.WriteRune(c)
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				closed = true
+			case c == '$' || c == '`':
+				return osReleaseField{}, false, fmt.Errorf("os-release field %s has an unescaped %c", key, c)
+			default:
+				value.WriteRune(c)
+			}
+		}
+
+		if !closed {
+			return osReleaseField{}, false, fmt.Errorf("os-release field %s has an unterminated double quoted value", key)
+		}
+
+		field.value = value.String()
+	default:
+		if strings.ContainsAny(raw, " \t\"'\\$`") {
+			return osReleaseField{}, false, fmt.Errorf("os-release field %s has a value with special characters, which must be quoted", key)
+		}
+
+		field.value = raw
+	}
+
+	return field, true, nil
+}
+
+// formatOSReleaseField formats a field as an os-release line, quoting its value if needed.
+func formatOSReleaseField(key, value string) string {
+	if value != "" && osReleaseUnquotedRegexp.MatchString(value) {
+		return key + "=" + value
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+
+	return key + `="` + replacer.Replace(value) + `"`
+}
+
+// ValidateOSRelease checks that data follows the os-release syntax, and has the fields sd-boot
+// names the boot entry after.
+func ValidateOSRelease(data []byte) error {
+	fields := map[string]string{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		field, ok, err := parseOSReleaseLine(line)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			fields[field.key] = field.value
+		}
+	}
+
+	for _, key := range osReleaseIDFields {
+		if value, ok := fields[key]; ok && !osReleaseIDRegexp.MatchString(value) {
+			return fmt.Errorf("os-release field %s=%q may only have lower case letters, digits, '.', '_' and '-'", key, value)
+		}
+	}
+
+	if value, ok := fields["BUILD_ID"]; ok && strings.ContainsAny(value, " \t") {
+		return fmt.Errorf("os-release field BUILD_ID=%q may not have spaces", value)
+	}
+
+	if fields["PRETTY_NAME"] == "" && fields["NAME"] == "" && fields["ID"] == "" && fields["IMAGE_ID"] == "" {
+		return errors.New("os-release has none of PRETTY_NAME, NAME, ID or IMAGE_ID, which sd-boot names the entry after")
+	}
+
+	return nil
+}
+
+// mergeOSRelease sets the fields of the os-release in data, replacing the existing assignments
+// in place, and appending the others.
+func mergeOSRelease(data []byte, fields []osReleaseField) ([]byte, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	for _, field := range fields {
+		replaced := false
+
+		for i, line := range lines {
+			existing, ok, err := parseOSReleaseLine(line)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok && existing.key == field.key {
+				lines[i] = formatOSReleaseField(field.key, field.value)
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			lines = append(lines, formatOSReleaseField(field.key, field.value))
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// toOSReleaseID turns value into a lower case identifier, replacing the characters it may not
+// have with '-', e.g. v3.2.1+k3s1 into v3.2.1-k3s1.
+func toOSReleaseID(value string) string {
+	return osReleaseIDInvalidRegexp.ReplaceAllString(strings.ToLower(value), "-")
+}
+
+// osReleaseFields returns the os-release fields given through the Builder.
+func (builder *Builder) osReleaseFields() []osReleaseField {
+	var fields []osReleaseField
+
+	for _, field := range []osReleaseField{
+		{"VERSION", builder.Version},
+		{"VERSION_ID", toOSReleaseID(builder.Version)},
+		{"IMAGE_ID", builder.ImageID},
+		{"IMAGE_VERSION", builder.ImageVersion},
+		{"BUILD_ID", builder.BuildID},
+		{"VARIANT_ID", builder.VariantID},
+		{"SYSEXT_LEVEL", builder.SysextLevel},
+	} {
+		if field.value != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+func (builder *Builder) generateOSRel() error {
+	var base []byte
+
+	if builder.OsRelease != "" {
+		slog.Debug("Using existing os-release", "path", builder.OsRelease)
+
+		var err error
+
+		if base, err = os.ReadFile(builder.OsRelease); err != nil {
+			return err
+		}
+	} else {
+		// Generate a simplified os-release
+		slog.Debug("Generating a new os-release")
+
+		pretty := constants.Name
+		if builder.Version != "" {
+			pretty += " (" + builder.Version + ")"
+		}
+
+		base = []byte(strings.Join([]string{
+			formatOSReleaseField("NAME", constants.Name),
+			formatOSReleaseField("ID", strings.ToLower(constants.Name)),
+			formatOSReleaseField("PRETTY_NAME", pretty),
+		}, "\n") + "\n")
+	}
+
+	osRelease, err := mergeOSRelease(base, builder.osReleaseFields())
+	if err != nil {
+		return err
+	}
+
+	if err = ValidateOSRelease(osRelease); err != nil {
+		return err
+	}
+
+	builder.sections = append(builder.sections,
+		types.UkiSection{
+			Name:    constants.OSRel,
+			Data:    osRelease,
+			Measure: true,
+			Append:  true,
+		},
+	)
+
+	return nil
+}
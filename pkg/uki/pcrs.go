@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// maxPCR is the highest PCR index TPMs are required to provide.
+const maxPCR = 23
+
+// pcrBanks are the PCR banks policies are signed for, by name.
+var pcrBanks = map[string]tpm2.TPMAlgID{
+	"sha1":   tpm2.TPMAlgSHA1,
+	"sha256": tpm2.TPMAlgSHA256,
+	"sha384": tpm2.TPMAlgSHA384,
+	"sha512": tpm2.TPMAlgSHA512,
+}
+
+// ParsePCRValue parses the value of a PCR given as PCR:BANK=HEX, e.g. 7:sha256=<digest>, as
+// accepted by Builder.PCRValues.
+func ParsePCRValue(spec string) (types.PCRValue, error) {
+	index, rest, ok := strings.Cut(spec, ":")
+	bank, value, ok2 := strings.Cut(rest, "=")
+
+	if !ok || !ok2 {
+		return types.PCRValue{}, fmt.Errorf("invalid PCR value %q, expected PCR:BANK=HEX", spec)
+	}
+
+	pcr, err := strconv.Atoi(index)
+	if err != nil || pcr < 0 || pcr > maxPCR {
+		return types.PCRValue{}, fmt.Errorf("invalid PCR %q, expected 0 to %d", index, maxPCR)
+	}
+
+	alg, ok := pcrBanks[strings.ToLower(bank)]
+	if !ok {
+		return types.PCRValue{}, fmt.Errorf("invalid PCR bank %q, expected sha1, sha256, sha384 or sha512", bank)
+	}
+
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return types.PCRValue{}, fmt.Errorf("invalid value of PCR %d: %w", pcr, err)
+	}
+
+	hash, err := alg.Hash()
+	if err != nil {
+		return types.PCRValue{}, err
+	}
+
+	if len(data) != hash.Size() {
+		return types.PCRValue{}, fmt.Errorf("value of PCR %d is %d bytes long, expected %d for the %s bank", pcr, len(data), hash.Size(), bank)
+	}
+
+	return types.PCRValue{PCR: pcr, Alg: alg, Value: data}, nil
+}
+
+// policyPCRValues checks the PCRs of the signed policies, and returns the values of the ones
+// other than the UKIPCR.
+func (builder *Builder) policyPCRValues() ([]types.PCRValue, error) {
+	if len(builder.PCRs) == 0 {
+		if len(builder.PCRValues) > 0 {
+			return nil, errors.New("PCR values are given without the PCRs of the policy")
+		}
+
+		return nil, nil
+	}
+
+	if !slices.Contains(builder.PCRs, constants.UKIPCR) {
+		return nil, fmt.Errorf("the PCRs of the policy have to include PCR %d, which the UKI is measured to", constants.UKIPCR)
+	}
+
+	for i, pcr := range builder.PCRs {
+		if pcr < 0 || pcr > maxPCR {
+			return nil, fmt.Errorf("invalid PCR %d, expected 0 to %d", pcr, maxPCR)
+		}
+
+		if slices.Contains(builder.PCRs[:i], pcr) {
+			return nil, fmt.Errorf("PCR %d is given twice", pcr)
+		}
+
+		if pcr != constants.UKIPCR && !slices.ContainsFunc(builder.PCRValues, func(value types.PCRValue) bool { return value.PCR == pcr }) {
+			return nil, fmt.Errorf("no value is given for PCR %d", pcr)
+		}
+	}
+
+	for i, value := range builder.PCRValues {
+		if value.PCR == constants.UKIPCR || !slices.Contains(builder.PCRs, value.PCR) {
+			return nil, fmt.Errorf("a value is given for PCR %d, which is not one of the other PCRs of the policy", value.PCR)
+		}
+
+		if slices.ContainsFunc(builder.PCRValues[:i], func(other types.PCRValue) bool { return other.PCR == value.PCR && other.Alg == value.Alg }) {
+			return nil, fmt.Errorf("the value of PCR %d is given twice for the same bank", value.PCR)
+		}
+	}
+
+	return builder.PCRValues, nil
+}
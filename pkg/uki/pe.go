@@ -0,0 +1,384 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+)
+
+// Offsets of the optional header fields we touch, relative to the start of the optional header.
+//
+// These are the same for PE32 and PE32+ images.
+const (
+	optSizeOfCode            = 4
+	optSizeOfInitializedData = 8
+	optSizeOfImage           = 56
+	optSizeOfHeaders         = 60
+	optCheckSum              = 64
+
+	// sectionHeaderSize is the size of an entry in the section table.
+	sectionHeaderSize = 40
+)
+
+// peImage is an in-memory PE/COFF image that can be extended with new sections.
+//
+// It only covers what is needed to turn the sd-stub into a UKI: appending sections after
+// the last one, replacing the content of existing ones, and keeping the COFF and optional
+// headers consistent with them.
+type peImage struct {
+	data []byte
+
+	fileHeader    pe.FileHeader
+	sections      []pe.SectionHeader32
+	dataDirectory []pe.DataDirectory
+
+	fileHeaderOffset     int
+	optionalHeaderOffset int
+	sectionTableOffset   int
+
+	imageBase             uint64
+	sizeOfHeaders         uint32
+	maxSizeOfHeaders      uint32
+	sectionAlignment      uint32
+	fileAlignment         uint32
+	sizeOfCode            uint32
+	sizeOfInitializedData uint32
+}
+
+// newPEImage parses the PE headers out of data.
+func newPEImage(data []byte) (*peImage, error) {
+	peFile, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer peFile.Close() //nolint: errcheck
+
+	if len(peFile.Sections) == 0 {
+		return nil, errors.New("PE file has no sections")
+	}
+
+	// pe.NewFile already validated the DOS header, so e_lfanew is in range
+	peOffset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+
+	img := &peImage{
+		data:             data,
+		fileHeader:       peFile.FileHeader,
+		fileHeaderOffset: peOffset + 4,
+	}
+	img.optionalHeaderOffset = img.fileHeaderOffset + binary.Size(peFile.FileHeader)
+	img.sectionTableOffset = img.optionalHeaderOffset + int(peFile.FileHeader.SizeOfOptionalHeader)
+
+	switch header := peFile.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		img.imageBase = uint64(header.ImageBase)
+		img.sizeOfHeaders = header.SizeOfHeaders
+		img.sectionAlignment = header.SectionAlignment
+		img.fileAlignment = header.FileAlignment
+		img.sizeOfCode = header.SizeOfCode
+		img.sizeOfInitializedData = header.SizeOfInitializedData
+		img.dataDirectory = header.DataDirectory[:min(header.NumberOfRvaAndSizes, uint32(len(header.DataDirectory)))]
+	case *pe.OptionalHeader64:
+		img.imageBase = header.ImageBase
+		img.sizeOfHeaders = header.SizeOfHeaders
+		img.sectionAlignment = header.SectionAlignment
+		img.fileAlignment = header.FileAlignment
+		img.sizeOfCode = header.SizeOfCode
+		img.sizeOfInitializedData = header.SizeOfInitializedData
+		img.dataDirectory = header.DataDirectory[:min(header.NumberOfRvaAndSizes, uint32(len(header.DataDirectory)))]
+	default:
+		return nil, errors.New("failed to get optional header")
+	}
+
+	img.sections = make([]pe.SectionHeader32, peFile.FileHeader.NumberOfSections)
+	if err = binary.Read(bytes.NewReader(data[img.sectionTableOffset:]), binary.LittleEndian, img.sections); err != nil {
+		return nil, fmt.Errorf("failed to read section table: %w", err)
+	}
+
+	if img.directory(pe.IMAGE_DIRECTORY_ENTRY_SECURITY).Size != 0 {
+		return nil, errors.New("PE file is signed, appending sections would corrupt its certificate table")
+	}
+
+	if err = img.validateLayout(); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// validateLayout checks that the image can be safely extended with new sections.
+//
+// It also works out how far SizeOfHeaders can grow to make room for new section headers: all
+// the space before the first section data is unused, up to the last FileAlignment boundary before it.
+func (img *peImage) validateLayout() error {
+	if !isPowerOfTwo(img.fileAlignment) || !isPowerOfTwo(img.sectionAlignment) {
+		return fmt.Errorf("invalid PE alignment: SectionAlignment 0x%x, FileAlignment 0x%x", img.sectionAlignment, img.fileAlignment)
+	}
+
+	if img.sectionAlignment < img.fileAlignment {
+		return fmt.Errorf("invalid PE alignment: SectionAlignment 0x%x is smaller than FileAlignment 0x%x", img.sectionAlignment, img.fileAlignment)
+	}
+
+	firstVirtualAddress := uint32(math.MaxUint32)
+	firstRawData := uint32(math.MaxUint32)
+
+	for i, section := range img.sections {
+		name := sectionName(section)
+
+		if section.VirtualAddress%img.sectionAlignment != 0 {
+			return fmt.Errorf("section %s at 0x%x is not aligned to SectionAlignment 0x%x", name, section.VirtualAddress, img.sectionAlignment)
+		}
+
+		if i > 0 {
+			previous := img.sections[i-1]
+			if uint64(previous.VirtualAddress)+uint64(previous.VirtualSize) > uint64(section.VirtualAddress) {
+				return fmt.Errorf("section %s overlaps with section %s", name, sectionName(previous))
+			}
+		}
+
+		firstVirtualAddress = min(firstVirtualAddress, section.VirtualAddress)
+
+		if section.SizeOfRawData != 0 {
+			firstRawData = min(firstRawData, section.PointerToRawData)
+		}
+	}
+
+	// SizeOfHeaders has to stay a multiple of FileAlignment
+	img.maxSizeOfHeaders = max(min(firstRawData, firstVirtualAddress)&^(img.fileAlignment-1), img.sizeOfHeaders)
+
+	if img.sectionTableOffset+len(img.sections)*sectionHeaderSize > int(img.maxSizeOfHeaders) {
+		return errors.New("PE section table extends past the headers")
+	}
+
+	return nil
+}
+
+// appendSection adds a new section with the given content after the last section of the image.
+//
+// It returns the relative virtual address the section was placed at.
+func (img *peImage) appendSection(name string, content []byte, characteristics uint32) (uint32, error) {
+	if len(name) > len(pe.SectionHeader32{}.Name) {
+		return 0, fmt.Errorf("section name %s is too long", name)
+	}
+
+	sectionTableEnd := img.sectionTableOffset + (len(img.sections)+1)*sectionHeaderSize
+	if sectionTableEnd > int(img.maxSizeOfHeaders) {
+		return 0, fmt.Errorf("not enough header space to add section %s: the headers end at 0x%x", name, img.maxSizeOfHeaders)
+	}
+
+	if sectionTableEnd > int(img.sizeOfHeaders) {
+		img.sizeOfHeaders = uint32(alignUp(uint64(sectionTableEnd), uint64(img.fileAlignment)))
+	}
+
+	last := img.sections[len(img.sections)-1]
+
+	// the stub may carry unaligned trailing data (e.g. a symbol table), so align the new data explicitly
+	virtualAddress := alignUp(uint64(last.VirtualAddress)+uint64(last.VirtualSize), uint64(img.sectionAlignment))
+	pointerToRawData := alignUp(uint64(len(img.data)), uint64(img.fileAlignment))
+	sizeOfRawData := alignUp(uint64(len(content)), uint64(img.fileAlignment))
+
+	if virtualAddress+sizeOfRawData > math.MaxUint32 || pointerToRawData+sizeOfRawData > math.MaxUint32 {
+		return 0, fmt.Errorf("section %s does not fit in a PE image", name)
+	}
+
+	header := pe.SectionHeader32{
+		VirtualSize:      uint32(len(content)),
+		VirtualAddress:   uint32(virtualAddress),
+		SizeOfRawData:    uint32(sizeOfRawData),
+		PointerToRawData: uint32(pointerToRawData),
+		Characteristics:  characteristics,
+	}
+	copy(header.Name[:], name)
+
+	img.data = append(img.data, make([]byte, pointerToRawData-uint64(len(img.data)))...)
+	img.data = append(img.data, content...)
+	img.data = append(img.data, make([]byte, sizeOfRawData-uint64(len(content)))...)
+
+	img.sections = append(img.sections, header)
+
+	if characteristics&pe.IMAGE_SCN_CNT_CODE != 0 {
+		img.sizeOfCode += header.SizeOfRawData
+	} else {
+		img.sizeOfInitializedData += header.SizeOfRawData
+	}
+
+	return header.VirtualAddress, nil
+}
+
+// replaceSection replaces the content of an existing section of the image in place.
+//
+// It returns the relative virtual address of the section. The new content has to fit in the
+// file and memory space already taken by the section, as the sections after it are not moved.
+func (img *peImage) replaceSection(name string, content []byte) (uint32, error) {
+	i := img.sectionIndex(name)
+	if i == -1 {
+		return 0, fmt.Errorf("section %s not found", name)
+	}
+
+	section := &img.sections[i]
+
+	available := section.SizeOfRawData
+	if i+1 < len(img.sections) {
+		available = min(available, img.sections[i+1].VirtualAddress-section.VirtualAddress)
+	}
+
+	if uint64(len(content)) > uint64(available) {
+		return 0, fmt.Errorf("not enough space to replace section %s: 0x%x bytes available, 0x%x needed", name, available, len(content))
+	}
+
+	if uint64(section.PointerToRawData)+uint64(section.SizeOfRawData) > uint64(len(img.data)) {
+		return 0, fmt.Errorf("section %s is not backed by file data", name)
+	}
+
+	raw := img.data[section.PointerToRawData : section.PointerToRawData+section.SizeOfRawData]
+	clear(raw[copy(raw, content):])
+
+	section.VirtualSize = uint32(len(content))
+
+	return section.VirtualAddress, nil
+}
+
+// sectionIndex returns the index of the named section in the section table, or -1 if the image does not have it.
+func (img *peImage) sectionIndex(name string) int {
+	return slices.IndexFunc(img.sections, func(section pe.SectionHeader32) bool { return sectionName(section) == name })
+}
+
+// Bytes writes the updated headers back into the image and returns its contents.
+func (img *peImage) Bytes() ([]byte, error) {
+	img.fileHeader.NumberOfSections = uint16(len(img.sections))
+
+	var buf bytes.Buffer
+
+	if err := binary.Write(&buf, binary.LittleEndian, img.fileHeader); err != nil {
+		return nil, err
+	}
+
+	copy(img.data[img.fileHeaderOffset:], buf.Bytes())
+
+	buf.Reset()
+
+	if err := binary.Write(&buf, binary.LittleEndian, img.sections); err != nil {
+		return nil, err
+	}
+
+	copy(img.data[img.sectionTableOffset:], buf.Bytes())
+
+	last := img.sections[len(img.sections)-1]
+	sizeOfImage := alignUp(uint64(last.VirtualAddress)+uint64(last.VirtualSize), uint64(img.sectionAlignment))
+
+	optionalHeader := img.data[img.optionalHeaderOffset:]
+	binary.LittleEndian.PutUint32(optionalHeader[optSizeOfCode:], img.sizeOfCode)
+	binary.LittleEndian.PutUint32(optionalHeader[optSizeOfInitializedData:], img.sizeOfInitializedData)
+	binary.LittleEndian.PutUint32(optionalHeader[optSizeOfImage:], uint32(sizeOfImage))
+	binary.LittleEndian.PutUint32(optionalHeader[optSizeOfHeaders:], img.sizeOfHeaders)
+	// the checksum is stale once sections are added, so compute it last
+	binary.LittleEndian.PutUint32(optionalHeader[optCheckSum:], peChecksum(img.data, img.optionalHeaderOffset+optCheckSum))
+
+	return img.data, nil
+}
+
+// directory returns the given data directory entry, or an empty one if the image does not have it.
+func (img *peImage) directory(index int) pe.DataDirectory {
+	if index >= len(img.dataDirectory) {
+		return pe.DataDirectory{}
+	}
+
+	return img.dataDirectory[index]
+}
+
+// setTimestamp sets the COFF header and debug directory timestamps of the image.
+func (img *peImage) setTimestamp(timestamp uint32) error {
+	img.fileHeader.TimeDateStamp = timestamp
+
+	debug := img.directory(pe.IMAGE_DIRECTORY_ENTRY_DEBUG)
+	if debug.Size == 0 {
+		return nil
+	}
+
+	offset, err := img.fileOffset(debug.VirtualAddress, debug.Size)
+	if err != nil {
+		return fmt.Errorf("failed to locate debug directory: %w", err)
+	}
+
+	// each IMAGE_DEBUG_DIRECTORY entry is 28 bytes long, with the timestamp after the characteristics
+	const debugDirectorySize = 28
+
+	for entry := offset; entry+debugDirectorySize <= offset+int(debug.Size); entry += debugDirectorySize {
+		binary.LittleEndian.PutUint32(img.data[entry+4:], timestamp)
+	}
+
+	return nil
+}
+
+// fileOffset translates a range of relative virtual addresses into a file offset.
+func (img *peImage) fileOffset(rva, size uint32) (int, error) {
+	for _, section := range img.sections {
+		if rva >= section.VirtualAddress && uint64(rva)+uint64(size) <= uint64(section.VirtualAddress)+uint64(section.SizeOfRawData) {
+			offset := int(section.PointerToRawData) + int(rva-section.VirtualAddress)
+			if offset+int(size) > len(img.data) {
+				break
+			}
+
+			return offset, nil
+		}
+	}
+
+	return 0, fmt.Errorf("RVA 0x%x is not backed by file data", rva)
+}
+
+// peChecksum computes the PE image checksum, skipping the checksum field itself.
+//
+// This is the same algorithm as CheckSumMappedFile from imagehlp.
+func peChecksum(data []byte, checksumOffset int) uint32 {
+	var sum uint32
+
+	for i := 0; i < len(data); i += 2 {
+		if i == checksumOffset || i == checksumOffset+2 {
+			continue
+		}
+
+		word := uint32(data[i])
+		if i+1 < len(data) {
+			word |= uint32(data[i+1]) << 8
+		}
+
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	return sum + uint32(len(data))
+}
+
+// sectionCharacteristics returns the PE section flags for a section appended to the UKI.
+func sectionCharacteristics(name constants.Section) uint32 {
+	if name == constants.Linux {
+		return pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ
+	}
+
+	return pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ
+}
+
+// sectionName returns the name of a section as a string.
+func sectionName(section pe.SectionHeader32) string {
+	return string(bytes.TrimRight(section.Name[:], "\x00"))
+}
+
+// isPowerOfTwo reports whether v is a non-zero power of two.
+func isPowerOfTwo(v uint32) bool {
+	return v != 0 && v&(v-1) == 0
+}
+
+// alignUp rounds v up to the next multiple of alignment, which must be a power of two.
+func alignUp(v, alignment uint64) uint64 {
+	return (v + alignment - 1) &^ (alignment - 1)
+}
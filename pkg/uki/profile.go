@@ -0,0 +1,298 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+)
+
+// Profile is a profile of a multi-profile UKI, which systemd-stub boots with the sections of the
+// UKI, overridden by the ones of the profile.
+//
+// See https://uapi-group.org/specifications/specs/unified_kernel_image/#multi-profile-ukis.
+type Profile struct {
+	// ID of the profile, which boot entries select it by.
+	ID string `json:"id"`
+	// Title of the profile in the sd-boot menu.
+	Title string `json:"title,omitempty"`
+	// Fields are further KEY=VALUE fields of the .profile section, written in order of their keys.
+	Fields map[string]string `json:"fields,omitempty"`
+	// Cmdline replaces the cmdline of the UKI, and CmdlineAppend is appended to it.
+	Cmdline       string `json:"cmdline,omitempty"`
+	CmdlineAppend string `json:"cmdlineAppend,omitempty"`
+	// Paths to the initrd images replacing the ones of the UKI, concatenated in order. The
+	// credentials and extension images of the UKI are appended to them.
+	InitrdPaths []string `json:"initrds,omitempty"`
+	// Path to the devicetree blob replacing the one of the UKI.
+	DevicetreePath string `json:"devicetree,omitempty"`
+	// Path to the splash image replacing the one of the UKI.
+	Splash string `json:"splash,omitempty"`
+	// Paths to the CPU microcode replacing the one of the UKI.
+	Microcode []string `json:"microcode,omitempty"`
+}
+
+// LoadProfile reads a profile description file, as JSON. Relative paths in it are relative to
+// the directory of the file.
+func LoadProfile(path string) (Profile, error) {
+	var profile Profile
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return profile, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err = decoder.Decode(&profile); err != nil {
+		return profile, fmt.Errorf("%s: %w", path, err)
+	}
+
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+
+		return filepath.Join(filepath.Dir(path), p)
+	}
+
+	for i := range profile.InitrdPaths {
+		profile.InitrdPaths[i] = resolve(profile.InitrdPaths[i])
+	}
+
+	for i := range profile.Microcode {
+		profile.Microcode[i] = resolve(profile.Microcode[i])
+	}
+
+	profile.DevicetreePath = resolve(profile.DevicetreePath)
+	profile.Splash = resolve(profile.Splash)
+
+	return profile, nil
+}
+
+// validate checks the profile can be written as a .profile section.
+func (profile Profile) validate() error {
+	if !osReleaseIDRegexp.MatchString(profile.ID) {
+		return fmt.Errorf("invalid profile ID %q, it may only have lower case letters, digits, '.', '_' and '-'", profile.ID)
+	}
+
+	for key := range profile.Fields {
+		if !osReleaseKeyRegexp.MatchString(key) || key == "ID" || key == "TITLE" {
+			return fmt.Errorf("profile %s has an invalid field %q", profile.ID, key)
+		}
+	}
+
+	return nil
+}
+
+// section returns the contents of the .profile section.
+func (profile Profile) section() []byte {
+	lines := []string{formatOSReleaseField("ID", profile.ID)}
+
+	if profile.Title != "" {
+		lines = append(lines, formatOSReleaseField("TITLE", profile.Title))
+	}
+
+	keys := make([]string, 0, len(profile.Fields))
+	for key := range profile.Fields {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		lines = append(lines, formatOSReleaseField(key, profile.Fields[key]))
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// profiles returns the profiles of the UKI, with ExtraCmdlines as profiles named after their
+// position, after a first one without overrides.
+func (builder *Builder) profiles() ([]Profile, error) {
+	if len(builder.ExtraCmdlines) == 0 {
+		return builder.Profiles, nil
+	}
+
+	if len(builder.Profiles) > 0 {
+		return nil, errors.New("extra cmdlines cannot be given together with profiles")
+	}
+
+	profiles := []Profile{{ID: "profile-0"}}
+
+	for i, cmdline := range builder.ExtraCmdlines {
+		if strings.TrimSpace(cmdline) == "" {
+			return nil, fmt.Errorf("extra cmdline %d is empty", i+1)
+		}
+
+		profiles = append(profiles, Profile{ID: fmt.Sprintf("profile-%d", i+1), Cmdline: cmdline})
+	}
+
+	return profiles, nil
+}
+
+// profileSections returns the .profile section of the profile, followed by the ones it overrides.
+func (builder *Builder) profileSections(profile Profile) ([]types.UkiSection, error) {
+	// systemd-stub measures the .profile section of the profile it boots, like the ones it overrides
+	sections := []types.UkiSection{{Name: constants.Profile, Data: profile.section(), Measure: true, Append: true}}
+
+	add := func(name constants.Section, data []byte) {
+		sections = append(sections, types.UkiSection{Name: name, Data: data, Measure: true, Append: true})
+	}
+
+	if profile.Cmdline != "" || profile.CmdlineAppend != "" {
+		cmdline := builder.Cmdline
+		if profile.Cmdline != "" {
+			cmdline = profile.Cmdline
+		}
+
+		cmdline, err := builder.resolveCmdline(strings.TrimSpace(cmdline + " " + profile.CmdlineAppend))
+		if err != nil {
+			return nil, err
+		}
+
+		add(constants.CMDLine, []byte(cmdline))
+	}
+
+	if len(profile.InitrdPaths) > 0 {
+		var data []byte
+
+		for _, path := range profile.InitrdPaths {
+			initrd, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error reading initrd: %w", err)
+			}
+
+			data = appendAligned(data, initrd)
+		}
+
+		extra, err := builder.extraInitrd()
+		if err != nil {
+			return nil, err
+		}
+
+		if extra != nil {
+			data = appendAligned(data, extra)
+		}
+
+		add(constants.Initrd, data)
+	}
+
+	if len(profile.Microcode) > 0 {
+		data, err := readMicrocode(builder.arch, profile.Microcode)
+		if err != nil {
+			return nil, err
+		}
+
+		add(constants.UCode, data)
+	}
+
+	if profile.Splash != "" {
+		data, err := readSplash(profile.Splash)
+		if err != nil {
+			return nil, err
+		}
+
+		add(constants.Splash, data)
+	}
+
+	if profile.DevicetreePath != "" {
+		data, err := readDTB(profile.DevicetreePath)
+		if err != nil {
+			return nil, err
+		}
+
+		add(constants.DTB, data)
+	}
+
+	return sections, nil
+}
+
+// generateProfiles appends the sections of each profile after the ones of the UKI, each followed
+// by the .pcrsig signed for the sections systemd-stub measures when booting it.
+func (builder *Builder) generateProfiles() error {
+	profiles, err := builder.profiles()
+	if err != nil || len(profiles) == 0 {
+		return err
+	}
+
+	// the sections of the UKI, before the first .profile
+	baseContent, err := utils.SectionsContent(builder.sections)
+	if err != nil {
+		return err
+	}
+
+	ids := map[string]bool{}
+
+	for _, profile := range profiles {
+		if err = profile.validate(); err != nil {
+			return err
+		}
+
+		if ids[profile.ID] {
+			return fmt.Errorf("profile %s is given twice", profile.ID)
+		}
+
+		ids[profile.ID] = true
+
+		sections, err := builder.profileSections(profile)
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", profile.ID, err)
+		}
+
+		slog.Debug("Adding profile", "id", profile.ID, "sections", len(sections)-1)
+
+		overrides, err := utils.SectionsContent(sections)
+		if err != nil {
+			return err
+		}
+
+		sectionsContent := measure.SectionsContent{}
+		for k, v := range baseContent {
+			sectionsContent[k] = v
+		}
+
+		for k, v := range overrides {
+			sectionsContent[k] = v
+		}
+
+		builder.sections = append(builder.sections, sections...)
+
+		if !builder.pcrSignEnabled() {
+			slog.Info("Measurements", "profile", profile.ID)
+			builder.printMeasurements(sectionsContent)
+
+			continue
+		}
+
+		slog.Info("Generating signed PCR policy", "profile", profile.ID)
+
+		pcrSig, err := builder.signPCR(sectionsContent)
+		if err != nil {
+			return err
+		}
+
+		builder.sections = append(builder.sections, types.UkiSection{
+			Name:   constants.PCRSig,
+			Data:   pcrSig,
+			Append: true,
+		})
+	}
+
+	return nil
+}
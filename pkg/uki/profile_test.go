@@ -0,0 +1,184 @@
+package uki
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// Policies of PCR 11 for the enter-initrd, leave-initrd, sysinit and ready phases of the sections
+// below, as replayed by replayPolicies.
+var (
+	goldenSingleProfile = []string{
+		"42f3a8d7a5549197b1c1b6d503ed6dee68169cda32bf7d76239b76efa40c097b",
+		"d98d34c53b529f95e86323fc06e769d76f8f6e898fc7c113dfda1b67b7a19597",
+		"f34b0938ad360a08e4edfee1ba531da3735b8f5971ba1637810e45f6f54e8353",
+		"8ac824f3b6a97d9421acccf52c0eea1f6e0443cbd22082eb3b8cfa1d75cf0a66",
+	}
+	// base sections, and ID=default TITLE=Kairos as .profile
+	goldenDefaultProfile = []string{
+		"a363f6c403d1dc842e8ab11283f4a08313ede508e208b1e18dd517b94aedbd0f",
+		"3607c0aab10450380c7cb1cb3a9535f2131ce77da366cc77da93c1bc3e861d55",
+		"639b9a075425c43d8e35edd97b67c5a0d9b3184689515d7ff407d67447ec8b3f",
+		"de7d4ac975f1f08853380f403b11c59f9f7c40d2466c31b4d9c7ed027c72a066",
+	}
+	// base sections with the .cmdline and .initrd overridden, and ID=recovery TITLE=Recovery as .profile
+	goldenRecoveryProfile = []string{
+		"8b385485a1a77bd4353f66addaa4ac1e958f149f29bafd36a368562d3d5bd36a",
+		"ff9317a7d4c2f39998bf48e63a3b7e6e194ef8f53fb54d6d8f4f16b450632ef9",
+		"af3e944e14c456ce565be2a27589cbbd474fa5138afafb89ed88b284de74e718",
+		"3241db5e9a53c245422d279d6c25808a9339e981f57d0399e0b88805686fb294",
+	}
+)
+
+// replayPolicies replays the events systemd-stub and systemd-pcrphase extend PCR 11 with in the
+// SHA256 bank, with nothing but crypto/sha256, and returns the PolicyPCR digest of each phase.
+//
+// systemd-stub measures the name of each section, NUL terminated, then its contents, in the order
+// of the unified_sections enum of systemd's src/fundamental/uki.h.
+func replayPolicies(sections map[string]string) []string {
+	// the sections used here, in the order of the enum
+	stubOrder := []string{".linux", ".osrel", ".cmdline", ".initrd", ".profile"}
+
+	pcr := make([]byte, sha256.Size)
+	extend := func(data string) {
+		digest := sha256.Sum256([]byte(data))
+		sum := sha256.Sum256(append(pcr, digest[:]...))
+		pcr = sum[:]
+	}
+
+	for _, name := range stubOrder {
+		if content, ok := sections[name]; ok {
+			extend(name + "\x00")
+			extend(content)
+		}
+	}
+
+	var digests []string
+
+	for _, phase := range []string{"enter-initrd", "leave-initrd", "sysinit", "ready"} {
+		extend(phase)
+
+		// TPM2_PolicyPCR from an empty policy: H(zeros || TPM_CC_PolicyPCR || TPML_PCR_SELECTION || H(PCR 11)),
+		// with a single selection of PCR 11 in the SHA256 bank
+		pcrDigest := sha256.Sum256(pcr)
+		policy := make([]byte, sha256.Size)
+		policy = binary.BigEndian.AppendUint32(policy, 0x17f)
+		policy = binary.BigEndian.AppendUint32(policy, 1)
+		policy = binary.BigEndian.AppendUint16(policy, 0x000b)
+		policy = append(policy, 3, 0, 1<<(11-8), 0)
+		policy = append(policy, pcrDigest[:]...)
+
+		digest := sha256.Sum256(policy)
+		digests = append(digests, hex.EncodeToString(digest[:]))
+	}
+
+	return digests
+}
+
+// policies returns the SHA256 policy digests of each .pcrsig section, in order.
+func policies(sections []types.UkiSection) [][]string {
+	var pols [][]string
+
+	for _, section := range sections {
+		if section.Name != constants.PCRSig {
+			continue
+		}
+
+		var pcrData types.PCRData
+		Expect(json.Unmarshal(section.Data, &pcrData)).To(Succeed())
+
+		var digests []string
+		for _, bank := range pcrData.SHA256 {
+			Expect(bank.PCRs).To(Equal([]int{constants.UKIPCR}))
+			digests = append(digests, bank.Pol)
+		}
+
+		pols = append(pols, digests)
+	}
+
+	return pols
+}
+
+var _ = Describe("Profile measurements", func() {
+	var builder *Builder
+
+	BeforeEach(func() {
+		signer, err := pesign.NewPCRSigner("../measure/pcr/testdata/private.pem")
+		Expect(err).ToNot(HaveOccurred())
+
+		builder = &Builder{
+			Cmdline:   "console=ttyS0",
+			PCRSigner: signer,
+			Phases:    types.OrderedPhases(),
+		}
+
+		for _, section := range []types.UkiSection{
+			{Name: constants.OSRel, Data: []byte("ID=kairos\n")},
+			{Name: constants.CMDLine, Data: []byte("console=ttyS0")},
+			{Name: constants.Initrd, Data: []byte("initrd")},
+			{Name: constants.Linux, Data: []byte("kernel")},
+		} {
+			section.Measure = true
+			section.Append = true
+			builder.sections = append(builder.sections, section)
+		}
+	})
+
+	It("Measures .profile right after .pcrpkey", func() {
+		ordered := constants.OrderedSections()
+		Expect(ordered).ToNot(ContainElement(constants.PCRSig))
+
+		i := slices.Index(ordered, constants.PCRPKey)
+		Expect(i).To(BeNumerically(">=", 0))
+		Expect(ordered[i+1:]).To(Equal([]constants.Section{constants.Profile, constants.DTBAuto, constants.HWIDs}))
+	})
+
+	It("Derives the golden policies from a replay of the PCR 11 events", func() {
+		base := map[string]string{".linux": "kernel", ".osrel": "ID=kairos\n", ".cmdline": "console=ttyS0", ".initrd": "initrd"}
+		Expect(replayPolicies(base)).To(Equal(goldenSingleProfile))
+
+		base[".profile"] = "ID=default\nTITLE=Kairos\n"
+		Expect(replayPolicies(base)).To(Equal(goldenDefaultProfile))
+
+		base[".profile"] = "ID=recovery\nTITLE=Recovery\n"
+		base[".cmdline"] = "console=ttyS0 kairos.recovery"
+		base[".initrd"] = "recovery"
+		Expect(replayPolicies(base)).To(Equal(goldenRecoveryProfile))
+	})
+
+	It("Matches the golden policies of a single profile UKI", func() {
+		Expect(builder.generateProfiles()).To(Succeed())
+		Expect(builder.generatePCRSig()).To(Succeed())
+		Expect(policies(builder.sections)).To(Equal([][]string{goldenSingleProfile}))
+	})
+
+	It("Matches the golden policies of each profile", func() {
+		tmpDir, err := os.MkdirTemp("", "uki")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+
+		recoveryInitrd := filepath.Join(tmpDir, "recovery.cpio")
+		Expect(os.WriteFile(recoveryInitrd, []byte("recovery"), 0o600)).To(Succeed())
+
+		builder.Profiles = []Profile{
+			{ID: "default", Title: "Kairos"},
+			{ID: "recovery", Title: "Recovery", CmdlineAppend: "kairos.recovery", InitrdPaths: []string{recoveryInitrd}},
+		}
+
+		Expect(builder.generateProfiles()).To(Succeed())
+		Expect(builder.generatePCRSig()).To(Succeed())
+		Expect(policies(builder.sections)).To(Equal([][]string{goldenDefaultProfile, goldenRecoveryProfile}))
+	})
+})
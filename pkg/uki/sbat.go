@@ -5,10 +5,14 @@
 package uki
 
 import (
+	"bytes"
 	"debug/pe"
 	"errors"
-	"github.com/kairos-io/go-ukify/pkg/constants"
 	"log/slog"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/sbat"
 )
 
 // GetSBAT returns the SBAT section from the PE file.
@@ -21,6 +25,11 @@ func GetSBAT(path string) ([]byte, error) {
 
 	defer pefile.Close() //nolint:errcheck
 
+	return getSBAT(pefile)
+}
+
+// getSBAT returns the SBAT section from an opened PE file.
+func getSBAT(pefile *pe.File) ([]byte, error) {
 	for _, section := range pefile.Sections {
 		if section.Name == string(constants.SBAT) {
 			data, err := section.Data()
@@ -34,3 +43,32 @@ func GetSBAT(path string) ([]byte, error) {
 
 	return nil, errors.New("could not find SBAT section")
 }
+
+// mergeSBAT appends the entries of extra to the SBAT of the stub.
+//
+// The sbat version line is kept once, at the top.
+func mergeSBAT(stub, extra []byte) []byte {
+	lines := []string{sbat.Header}
+
+	for _, data := range [][]byte{stub, extra} {
+		// the section is padded with NULs past its content
+		for _, line := range strings.Split(string(bytes.TrimRight(data, "\x00")), "\n") {
+			if line == "" || strings.HasPrefix(line, "sbat,") {
+				continue
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// ValidateSBAT checks that data is well formed SBAT CSV.
+//
+// See https://github.com/rhboot/shim/blob/main/SBAT.md.
+func ValidateSBAT(data []byte) error {
+	_, err := sbat.Parse(data)
+
+	return err
+}
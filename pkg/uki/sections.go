@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// managedSections are the systemd sections which the builder places itself, as their position
+// in the UKI matters, so they cannot be given as extra sections.
+var managedSections = []constants.Section{
+	constants.Linux,
+	constants.SBAT,
+	constants.PCRSig,
+	constants.Profile,
+}
+
+// ParseSection parses a section given as NAME:PATH[:measure], as accepted by Builder.ExtraSections.
+func ParseSection(spec string) (types.UkiSection, error) {
+	name, path, ok := strings.Cut(spec, ":")
+	if !ok || name == "" || path == "" {
+		return types.UkiSection{}, fmt.Errorf("invalid section %q, expected NAME:PATH[:measure]", spec)
+	}
+
+	path, measure := strings.CutSuffix(path, ":measure")
+
+	return types.UkiSection{
+		Name:    constants.Section(name),
+		Path:    path,
+		Measure: measure,
+		Append:  true,
+	}, nil
+}
+
+// generateExtraSections appends the user given sections, after checking they do not clash with
+// the sections of the sd-stub, or the ones generated by the builder.
+func (builder *Builder) generateExtraSections() error {
+	stub, err := pe.NewFile(bytes.NewReader(builder.stubData))
+	if err != nil {
+		return err
+	}
+
+	defer stub.Close() //nolint:errcheck
+
+	// before the other checks, as the first one would be taken for a section of the builder
+	for i, section := range builder.ExtraSections {
+		if slices.ContainsFunc(builder.ExtraSections[:i], func(s types.UkiSection) bool { return s.Name == section.Name }) {
+			return fmt.Errorf("extra section %s is given twice", section.Name)
+		}
+	}
+
+	for _, section := range builder.ExtraSections {
+		if err = builder.checkExtraSection(stub, section); err != nil {
+			return err
+		}
+
+		slog.Debug("Using extra section", "section", section.Name, "path", section.Path, "measure", section.Measure)
+
+		section.Append = true
+		builder.sections = append(builder.sections, section)
+	}
+
+	return nil
+}
+
+// checkExtraSection checks the name of a user given section, and that it is measured if and only
+// if systemd-stub measures it.
+func (builder *Builder) checkExtraSection(stub *pe.File, section types.UkiSection) error {
+	name := section.Name
+
+	if name == "" {
+		return errors.New("extra section has no name")
+	}
+
+	if len(name) > len(pe.SectionHeader32{}.Name) {
+		return fmt.Errorf("extra section name %s is longer than the %d bytes allowed by PE", name, len(pe.SectionHeader32{}.Name))
+	}
+
+	if slices.Contains(managedSections, name) {
+		return fmt.Errorf("extra section %s is reserved by systemd, and managed by the builder", name)
+	}
+
+	if slices.ContainsFunc(builder.sections, func(s types.UkiSection) bool { return s.Name == name }) {
+		return fmt.Errorf("extra section %s is reserved by systemd, and already generated by the builder", name)
+	}
+
+	if stub.Section(string(name)) != nil {
+		return fmt.Errorf("extra section %s is already part of the sd-stub", name)
+	}
+
+	measured := slices.Contains(constants.OrderedSections(), name)
+
+	switch {
+	case section.Measure && !measured:
+		return fmt.Errorf("extra section %s cannot be measured, systemd-stub only measures the sections it knows", name)
+	case !section.Measure && measured:
+		return fmt.Errorf("extra section %s is always measured by systemd-stub, it has to be marked as measured", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // registers the JPEG format for image.Decode
+	_ "image/png"  // registers the PNG format for image.Decode
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/kairos-io/go-ukify/internal/common"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// BMP constants, based on the BMP parser of systemd-stub in src/boot/bmp.c.
+const (
+	bmpFileHeaderSize = 14
+	bmpInfoHeaderSize = 40
+	// bmpMaxWidth and bmpMaxHeight is the size of the smallest common GOP mode, as systemd-stub
+	// does not show splash images larger than the screen.
+	bmpMaxWidth  = 1024
+	bmpMaxHeight = 768
+)
+
+// bmpDepths are the bits per pixel supported by systemd-stub.
+var bmpDepths = []uint16{1, 4, 8, 16, 24, 32}
+
+// ValidateBMP checks that data is a BMP image systemd-stub can show, and returns its dimensions.
+func ValidateBMP(data []byte) (int, int, error) {
+	if len(data) < bmpFileHeaderSize+bmpInfoHeaderSize || !bytes.HasPrefix(data, []byte("BM")) {
+		return 0, 0, errors.New("splash is not a BMP image")
+	}
+
+	offset := binary.LittleEndian.Uint32(data[10:])
+	dibSize := binary.LittleEndian.Uint32(data[14:])
+	width := int32(binary.LittleEndian.Uint32(data[18:]))
+	height := int32(binary.LittleEndian.Uint32(data[22:]))
+	planes := binary.LittleEndian.Uint16(data[26:])
+	depth := binary.LittleEndian.Uint16(data[28:])
+	compression := binary.LittleEndian.Uint32(data[30:])
+
+	if dibSize < bmpInfoHeaderSize || planes != 1 {
+		return 0, 0, fmt.Errorf("splash has an unsupported BMP header of %d bytes and %d planes", dibSize, planes)
+	}
+
+	if !slices.Contains(bmpDepths, depth) {
+		return 0, 0, fmt.Errorf("splash has an unsupported depth of %d bits per pixel", depth)
+	}
+
+	// uncompressed, or uncompressed with color masks (BI_BITFIELDS), which only 16 and 32-bit images have
+	if compression != 0 && compression != 3 {
+		return 0, 0, fmt.Errorf("splash has an unsupported BMP compression %d, only uncompressed images are supported", compression)
+	}
+
+	if compression == 3 && depth != 16 && depth != 32 {
+		return 0, 0, fmt.Errorf("splash has color masks at a depth of %d bits per pixel, they are only supported at 16 and 32", depth)
+	}
+
+	if width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("splash has invalid dimensions %dx%d, only bottom-up images are supported", width, height)
+	}
+
+	rowSize := (uint64(width)*uint64(depth) + 31) / 32 * 4
+	if uint64(offset)+rowSize*uint64(height) > uint64(len(data)) {
+		return 0, 0, fmt.Errorf("splash pixel data of %dx%d at %d bits per pixel extends past its %d bytes", width, height, depth, len(data))
+	}
+
+	return int(width), int(height), nil
+}
+
+// encodeBMP encodes img as an uncompressed 24-bit BMP, composited over the black background
+// systemd-stub draws on.
+func encodeBMP(img image.Image) []byte {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rowSize := (width*3 + 3) &^ 3
+	imageSize := rowSize * height
+
+	data := make([]byte, bmpFileHeaderSize+bmpInfoHeaderSize, bmpFileHeaderSize+bmpInfoHeaderSize+imageSize)
+
+	copy(data, "BM")
+	binary.LittleEndian.PutUint32(data[2:], uint32(cap(data)))
+	binary.LittleEndian.PutUint32(data[10:], bmpFileHeaderSize+bmpInfoHeaderSize)
+	binary.LittleEndian.PutUint32(data[14:], bmpInfoHeaderSize)
+	binary.LittleEndian.PutUint32(data[18:], uint32(width))
+	binary.LittleEndian.PutUint32(data[22:], uint32(height))
+	binary.LittleEndian.PutUint16(data[26:], 1)
+	binary.LittleEndian.PutUint16(data[28:], 24)
+	binary.LittleEndian.PutUint32(data[34:], uint32(imageSize))
+
+	row := make([]byte, rowSize)
+
+	// rows are stored bottom-up, with pixels in BGR order
+	for y := bounds.Max.Y - 1; y >= bounds.Min.Y; y-- {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// colors are alpha-premultiplied, which composites them over black
+			r, g, b, _ := img.At(x, y).RGBA()
+			i := (x - bounds.Min.X) * 3
+			row[i], row[i+1], row[i+2] = byte(b>>8), byte(g>>8), byte(r>>8)
+		}
+
+		data = append(data, row...)
+	}
+
+	return data
+}
+
+// readSplash reads the splash image at path, converting PNG and JPEG images to BMP.
+func readSplash(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading splash: %w", err)
+	}
+
+	if !bytes.HasPrefix(data, []byte("BM")) {
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither a BMP, PNG nor JPEG image: %w", path, err)
+		}
+
+		slog.Debug("Converting splash to BMP", "path", path, "format", format)
+
+		data = encodeBMP(img)
+	}
+
+	width, height, err := ValidateBMP(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if width > bmpMaxWidth || height > bmpMaxHeight {
+		slog.Warn("Splash is larger than the smallest common screen resolution, it will not be shown on smaller screens",
+			"path", path, "size", fmt.Sprintf("%dx%d", width, height), "max", fmt.Sprintf("%dx%d", bmpMaxWidth, bmpMaxHeight))
+	}
+
+	return data, nil
+}
+
+func (builder *Builder) generateSplash() error {
+	var data []byte
+
+	switch {
+	case builder.NoSplash && builder.Splash != "":
+		return errors.New("a splash cannot be given when disabling the splash")
+	case builder.NoSplash:
+		slog.Debug("Not using a splash")
+
+		return nil
+	case builder.Splash != "":
+		slog.Debug("Using splash", "file", builder.Splash)
+
+		var err error
+
+		if data, err = readSplash(builder.Splash); err != nil {
+			return err
+		}
+	default:
+		slog.Debug("Using generic bundled splash")
+		data = common.Logo
+	}
+
+	builder.sections = append(builder.sections,
+		types.UkiSection{
+			Name:    constants.Splash,
+			Data:    data,
+			Measure: true,
+			Append:  true,
+		},
+	)
+
+	return nil
+}
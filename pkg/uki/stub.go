@@ -0,0 +1,172 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bufio"
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// sdMagicRegexp matches the .sdmagic section of systemd EFI binaries, e.g. "#### LoaderInfo: systemd-stub 257.2 ####".
+var sdMagicRegexp = regexp.MustCompile(`#### LoaderInfo: (\S+) (\S+) ####`)
+
+// sectionMinVersion is the systemd version in which the sd-stub started honoring a section.
+var sectionMinVersion = map[constants.Section]int{
+	constants.UCode:   256,
+	constants.Profile: 257,
+	constants.DTBAuto: 257,
+	constants.HWIDs:   257,
+}
+
+// StubInfo describes the sd-stub a UKI is built from.
+type StubInfo struct {
+	// Name of the EFI binary, e.g. systemd-stub.
+	Name string
+	// Version as reported by the binary, e.g. 257.2-1.fc41.
+	Version string
+	// Major is the systemd version the binary comes from, 0 if it could not be detected.
+	Major int
+}
+
+// GetStubInfo detects the name and version of the sd-stub from its .sdmagic section, falling
+// back to its .osrel section.
+func GetStubInfo(path string) (*StubInfo, error) {
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer peFile.Close() //nolint:errcheck
+
+	return stubInfo(peFile)
+}
+
+// stubInfo detects the name and version of an opened sd-stub, see GetStubInfo.
+func stubInfo(peFile *pe.File) (*StubInfo, error) {
+	info := &StubInfo{}
+
+	if data, err := sectionContent(peFile, ".sdmagic"); err != nil {
+		return nil, err
+	} else if match := sdMagicRegexp.FindSubmatch(data); match != nil {
+		info.Name = string(match[1])
+		info.Version = string(match[2])
+	}
+
+	if info.Version == "" {
+		data, err := sectionContent(peFile, string(constants.OSRel))
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), "=")
+			value = strings.Trim(value, `"'`)
+
+			switch key {
+			case "ID":
+				info.Name = value
+			case "VERSION":
+				info.Version = value
+			}
+		}
+	}
+
+	// versions look like 257, 257.2, 257~rc1 or 257.2-1.fc41
+	digits := strings.IndexFunc(info.Version, func(r rune) bool { return r < '0' || r > '9' })
+	if digits == -1 {
+		digits = len(info.Version)
+	}
+
+	info.Major, _ = strconv.Atoi(info.Version[:digits]) //nolint:errcheck
+
+	return info, nil
+}
+
+// Supports reports whether the sd-stub honors the given section.
+//
+// Sections are assumed supported if the version of the stub is unknown.
+func (info *StubInfo) Supports(section constants.Section) bool {
+	minVersion, ok := sectionMinVersion[section]
+
+	return !ok || info.Major == 0 || info.Major >= minVersion
+}
+
+// String returns a human readable description of the sd-stub.
+func (info *StubInfo) String() string {
+	if info.Version == "" {
+		return "unknown sd-stub"
+	}
+
+	return fmt.Sprintf("%s %s", info.Name, info.Version)
+}
+
+// sectionContent returns the content of the named section, or nil if the PE file does not have it.
+func sectionContent(peFile *pe.File, name string) ([]byte, error) {
+	section := peFile.Section(name)
+	if section == nil {
+		return nil, nil
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	return data[:min(section.VirtualSize, uint32(len(data)))], nil
+}
+
+// detectStub detects the sd-stub version, warning if it does not look like a systemd-stub.
+func (builder *Builder) detectStub() error {
+	stub, err := pe.NewFile(bytes.NewReader(builder.stubData))
+	if err != nil {
+		return err
+	}
+
+	defer stub.Close() //nolint:errcheck
+
+	builder.stub, err = stubInfo(stub)
+	if err != nil {
+		return fmt.Errorf("failed to detect sd-stub version: %w", err)
+	}
+
+	switch {
+	case builder.stub.Major == 0:
+		slog.Warn("Could not detect the sd-stub version, not checking which sections it supports", "path", builder.SdStubPath)
+	case builder.stub.Name != "systemd-stub":
+		slog.Warn("The sd-stub does not look like a systemd-stub", "path", builder.SdStubPath, "stub", builder.stub.String())
+	default:
+		slog.Debug("Detected sd-stub", "path", builder.SdStubPath, "stub", builder.stub.String())
+	}
+
+	return nil
+}
+
+// checkStubSupport refuses to build a UKI with sections the sd-stub would silently ignore.
+func (builder *Builder) checkStubSupport() error {
+	return checkStubSupport(builder.stub, builder.sections)
+}
+
+// checkStubSupport refuses to append sections the stub would silently ignore.
+func checkStubSupport(stub *StubInfo, sections []types.UkiSection) error {
+	for _, section := range sections {
+		if !section.Append || stub.Supports(section.Name) {
+			continue
+		}
+
+		return fmt.Errorf("%s does not support %s sections, systemd %d or newer is needed", stub.String(), section.Name, sectionMinVersion[section.Name])
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package uki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/kairos-io/go-ukify/pkg/types"
+)
+
+// microcodeDir is where the kernel early loader looks for the x86 microcode, based on
+// https://docs.kernel.org/arch/x86/microcode.html.
+const microcodeDir = "kernel/x86/microcode"
+
+// microcodeVendor returns the vendor of a raw x86 microcode blob, as named in microcodeDir.
+func microcodeVendor(data []byte) (string, bool) {
+	// AMD container files start with the "DMA\0" magic
+	if bytes.HasPrefix(data, []byte("DMA\x00")) {
+		return "AuthenticAMD", true
+	}
+
+	// Intel updates start with a header of version 1, with a loader revision of 1
+	if len(data) >= 48 && binary.LittleEndian.Uint32(data[0:]) == 1 && binary.LittleEndian.Uint32(data[20:]) == 1 {
+		return "GenuineIntel", true
+	}
+
+	return "", false
+}
+
+// readMicrocode reads the microcode cpio archives and raw vendor blobs at paths into a single
+// initrd for the .ucode section.
+//
+// The raw blobs of each vendor are concatenated into the file the kernel looks for, in an archive
+// placed before the given ones, as the kernel only loads the first file it finds for its vendor.
+func readMicrocode(arch Arch, paths []string) ([]byte, error) {
+	var archives []byte
+
+	blobs := map[string][]byte{}
+	vendors := []string{}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if initrd.IsCPIO(data) {
+			slog.Debug("Using microcode archive", "path", path)
+
+			archives = append(archives, data...)
+			archives = append(archives, make([]byte, alignUp(uint64(len(archives)), 4)-uint64(len(archives)))...)
+
+			continue
+		}
+
+		vendor, ok := microcodeVendor(data)
+		if !ok {
+			return nil, fmt.Errorf("%s is neither a cpio archive nor an Intel or AMD microcode blob", path)
+		}
+
+		if arch.Name != "x86_64" && arch.Name != "ia32" {
+			return nil, fmt.Errorf("%s is an %s microcode blob, which cannot be loaded on %s", path, vendor, arch.Name)
+		}
+
+		slog.Debug("Using microcode blob", "path", path, "vendor", vendor)
+
+		if _, ok := blobs[vendor]; !ok {
+			vendors = append(vendors, vendor)
+		}
+
+		blobs[vendor] = append(blobs[vendor], data...)
+	}
+
+	if len(vendors) == 0 {
+		return archives, nil
+	}
+
+	var ucode bytes.Buffer
+
+	w := initrd.NewWriter(&ucode)
+
+	for _, dir := range []string{"kernel", "kernel/x86", microcodeDir} {
+		if err := w.AddDir(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, vendor := range vendors {
+		if err := w.AddFile(microcodeDir+"/"+vendor+".bin", 0o644, blobs[vendor]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return append(ucode.Bytes(), archives...), nil
+}
+
+// generateUCode appends the .ucode section, which systemd-stub passes to the kernel as an initrd
+// before the .initrd one, so that the early microcode loader finds it.
+func (builder *Builder) generateUCode() error {
+	if len(builder.Microcode) == 0 {
+		return nil
+	}
+
+	data, err := readMicrocode(builder.arch, builder.Microcode)
+	if err != nil {
+		return err
+	}
+
+	builder.sections = append(builder.sections,
+		types.UkiSection{
+			Name:    constants.UCode,
+			Data:    data,
+			Measure: true,
+			Append:  true,
+		},
+	)
+
+	return nil
+}
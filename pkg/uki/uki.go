@@ -6,8 +6,10 @@
 package uki
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
@@ -20,21 +22,61 @@ import (
 type Builder struct {
 	// Source options.
 	//
-	// Arch of the UKI file.
+	// Arch of the UKI file, detected from the sd-stub if empty.
 	Arch string
-	// Version of Talos.
+	// Version of Talos, for the VERSION and VERSION_ID fields of the os-release.
 	Version string
-	// Path to the sd-stub.
+	// Fields of the os-release, which are merged into OsRelease when given.
+	ImageID      string
+	ImageVersion string
+	BuildID      string
+	VariantID    string
+	SysextLevel  string
+	// Path to the sd-stub, defaults to the systemd one for Arch.
 	SdStubPath string
 	// Path to the sd-boot.
 	SdBootPath string
 	// Path to the kernel image.
 	KernelPath string
+	// Uname is the kernel version for the .uname section, discovered from the kernel image, or from
+	// the lib/modules directory of the initrd, if empty.
+	Uname string
 	// Path to the initrd image.
 	InitrdPath string
+	// InitrdPaths are further initrd images, such as cpio overlays, concatenated in order after the
+	// InitrdPath (or Initrd) one into the .initrd section.
+	InitrdPaths []string
+	// SdStub, Kernel and Initrd are read instead of SdStubPath, KernelPath and InitrdPath when set.
+	// They are read to the end by the build, so new readers are needed to build again.
+	SdStub io.Reader
+	Kernel io.Reader
+	Initrd io.Reader
+	// Credentials, sysext and confext images are embedded in a cpio archive appended to the
+	// .initrd section, in the /.extra layout of systemd-stub, so that they are measured with it.
+	Credentials []Credential
+	Sysexts     []string
+	Confexts    []string
+	// Paths to the CPU microcode, as cpio archives or raw Intel and AMD blobs, which are wrapped in
+	// the kernel/x86/microcode layout the kernel expects.
+	Microcode []string
+	// Path to the devicetree blob, for the kernel to boot with instead of the one from the firmware.
+	DevicetreePath string
+	// Paths to the devicetree blobs systemd-stub picks from for the board it runs on, in order of preference.
+	DevicetreeAutoPaths []string
+	// HWIDs let systemd-stub pick one of DevicetreeAutoPaths for boards whose firmware has no devicetree.
+	HWIDs []HWID
 	// Kernel cmdline.
 	Cmdline string
-	// Os-release file
+	// Profiles make a multi-profile UKI, booting with the sections of the UKI overridden by the
+	// ones of the profile picked in the boot entry.
+	Profiles []Profile
+	// ExtraCmdlines is a shorthand for Profiles, making a first profile without overrides and one
+	// replacing the cmdline for each of them.
+	ExtraCmdlines []string
+	// SBAT entries added to the ones of the sd-stub, to be able to revoke the UKI through its own
+	// component generation.
+	SBAT string
+	// Os-release file, generated if empty
 	OsRelease string
 	// Phases to measure for
 	Phases []types.PhaseInfo
@@ -50,8 +92,29 @@ type Builder struct {
 	PCRSigner types.RSAKey
 	// Path to the PCR signing key
 	PCRKey string
+	// PCRs bound by the signed PCR policies, defaults to constants.UKIPCR alone, which the UKI is
+	// measured to. The other ones are bound to the PCRValues given for them, e.g. PCR 7 to the
+	// Secure Boot state, and only the banks all of them have a value for are signed.
+	PCRs      []int
+	PCRValues []types.PCRValue
 
+	// Path to the splash image, as BMP, PNG or JPEG. Defaults to the bundled Kairos logo.
 	Splash string
+	// NoSplash builds the UKI without a .splash section.
+	NoSplash bool
+
+	// ExtraSections are added to the UKI as is, before the kernel.
+	//
+	// Their names cannot clash with the sections of the sd-stub or the generated ones, and only the
+	// systemd sections measured by systemd-stub can, and have to, be marked as measured.
+	ExtraSections []types.UkiSection
+
+	// Reproducible sets the timestamps of the UKI to SourceDateEpoch, so that the same inputs always
+	// produce the same unsigned UKI. It is also enabled by the SOURCE_DATE_EPOCH environment variable.
+	Reproducible bool
+	// SourceDateEpoch in seconds, defaults to the SOURCE_DATE_EPOCH environment variable, or 0.
+	// Setting it enables Reproducible.
+	SourceDateEpoch int64
 
 	// Output options:
 	//
@@ -61,83 +124,102 @@ type Builder struct {
 	OutUKIPath string
 
 	// fields initialized during build
-	sections        []types.UkiSection
-	scratchDir      string
-	unsignedUKIPath string
-
-	ExtraCmdlines       []string
-	profileCmdlinePaths []string
+	arch       Arch
+	stub       *StubInfo
+	sections   []types.UkiSection
+	stubData   []byte
+	kernelData []byte
+	initrdData []byte
+	// root compatibles of the DevicetreeAutoPaths
+	dtbAutoCompatibles []string
 }
 
 // Build the UKI file.
 //
 // Build process is as follows:
 //   - sign the sd-boot EFI binary, and write it to the OutSdBootPath
-//   - build ephemeral sections (uname, os-release), and other proposed sections
-//   - measure sections, generate signature, and append to the list of sections
-//   - assemble the final UKI file starting from sd-stub and appending generated section.
+//   - build the UKI with BuildTo, and write it to the OutUKIPath.
 func (builder *Builder) Build() error {
-	var err error
-
-	// Check if we got any phases
-	if len(builder.Phases) == 0 {
-		// use default phases
-		builder.Phases = types.OrderedPhases()
+	if err := builder.initSigners(); err != nil {
+		return err
 	}
 
-	if builder.PCRSigner == nil {
-		if builder.PCRKey != "" {
-			signer, err := pesign.NewPCRSigner(builder.PCRKey)
-			if err != nil {
-				return err
-			}
-			builder.PCRSigner = signer
+	// Sign sd-boot if given and signing is enabled
+	if builder.SdBootPath != "" && builder.sbSignEnabled() {
+		slog.Info("Signing systemd-boot", "path", builder.SdBootPath)
+
+		// sign sd-boot
+		if err := builder.SecureBootSigner.Sign(builder.SdBootPath, builder.OutSdBootPath); err != nil {
+			return fmt.Errorf("error signing sd-boot: %w", err)
 		}
+
+		slog.Info("Signed systemd-boot", "path", builder.OutSdBootPath)
+	} else {
+		slog.Info("Not signing systemd-boot")
+	}
+
+	var uki bytes.Buffer
+
+	if err := builder.BuildTo(&uki); err != nil {
+		return err
 	}
 
-	// Try to generate a signer base on our given args
-	// If we have a	either a signer or key/cert
-	// Try to use first the signer as we can use a custom signed passed in the struct
-	// otherwise create a new default signer with the key and cert
 	if builder.sbSignEnabled() {
-		if builder.SecureBootSigner == nil {
-			if builder.SBCert != "" && builder.SBKey != "" {
-				sb, err := pesign.NewSecureBootSigner(builder.SBCert, builder.SBKey)
-				if err != nil {
-					return err
-				}
-				sbSigner, err := pesign.NewSigner(sb)
-				if err != nil {
-					return err
-				}
-				builder.SecureBootSigner = sbSigner
-			}
+		if err := os.WriteFile(builder.OutUKIPath, uki.Bytes(), 0o600); err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("Signed UKI at %s", builder.OutUKIPath))
+	} else {
+		unsignedUKIPath := strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1)
+		if err := os.WriteFile(unsignedUKIPath, uki.Bytes(), os.ModePerm); err != nil {
+			return err
 		}
+		slog.Info(fmt.Sprintf("Unsigned UKI at %s", unsignedUKIPath))
 	}
 
-	builder.scratchDir, err = os.MkdirTemp("", "ukify")
-	if err != nil {
+	return nil
+}
+
+// BuildTo builds the UKI file in memory and writes it to w.
+//
+// Build process is as follows:
+//   - read the sd-stub, kernel and initrds, from their readers if given or from their paths
+//   - build ephemeral sections (uname, os-release), and other proposed sections
+//   - measure sections, generate signature, and append to the list of sections
+//   - assemble the final UKI file starting from sd-stub and appending generated section
+//   - sign the UKI file if signing is enabled.
+//
+// Unlike Build, BuildTo does not sign sd-boot nor write any file.
+func (builder *Builder) BuildTo(w io.Writer) error {
+	var err error
+
+	builder.sections = nil
+	builder.dtbAutoCompatibles = nil
+
+	if err = builder.initSigners(); err != nil {
 		return err
 	}
 
-	defer func() {
-		if err = os.RemoveAll(builder.scratchDir); err != nil {
-			log.Printf("failed to remove scratch dir: %v", err)
-		}
-	}()
+	if err = builder.readInputs(); err != nil {
+		return err
+	}
 
-	// Sign sd-boot if given and signing is enabled
-	if builder.SdBootPath != "" && builder.sbSignEnabled() {
-		slog.Info("Signing systemd-boot", "path", builder.SdBootPath)
+	if err = builder.resolveArch(); err != nil {
+		return err
+	}
 
-		// sign sd-boot
-		if err = builder.SecureBootSigner.Sign(builder.SdBootPath, builder.OutSdBootPath); err != nil {
-			return fmt.Errorf("error signing sd-boot: %w", err)
-		}
+	if err = builder.checkArch(); err != nil {
+		return err
+	}
 
-		slog.Info("Signed systemd-boot", "path", builder.OutSdBootPath)
-	} else {
-		slog.Info("Not signing systemd-boot")
+	if err = builder.detectStub(); err != nil {
+		return err
+	}
+
+	// Check if we got any phases
+	if len(builder.Phases) == 0 {
+		// use default phases
+		builder.Phases = types.OrderedPhases()
 	}
 
 	slog.Info("Generating UKI sections")
@@ -147,14 +229,19 @@ func (builder *Builder) Build() error {
 		builder.generateOSRel,
 		builder.generateCmdline,
 		builder.generateInitrd,
+		builder.generateUCode,
 		builder.generateSplash,
+		builder.generateDTB,
+		builder.generateDTBAuto,
+		builder.generateHWIDs,
 		builder.generateUname,
 		builder.generateSBAT,
 		builder.generatePCRPublicKey,
+		builder.generateExtraSections,
 		// append kernel last to account for decompression
-		builder.generateKernel,            // shared payload ends here
-		builder.generateBaseProfileAndSig, // emits .profile(base) + .pcrsig(base) if extras exist
-		builder.generateExtraProfiles,     // emits (.profile + .cmdline + .pcrsig) per extra
+		builder.generateKernel,
+		// the sections of the UKI end here, the profiles override them
+		builder.generateProfiles,
 		// measure sections last
 		builder.generatePCRSig,
 	} {
@@ -165,10 +252,15 @@ func (builder *Builder) Build() error {
 
 	slog.Info("Generated UKI sections")
 
+	if err = builder.checkStubSupport(); err != nil {
+		return err
+	}
+
 	slog.Info("Assembling UKI")
 
 	// assemble the final UKI file
-	if err = builder.assemble(); err != nil {
+	uki, err := builder.assemble()
+	if err != nil {
 		return fmt.Errorf("error assembling UKI: %w", err)
 	}
 
@@ -177,24 +269,129 @@ func (builder *Builder) Build() error {
 	// sign the UKI file if signing is enabled
 	if builder.sbSignEnabled() {
 		slog.Info("Signing UKI")
-		err = builder.SecureBootSigner.Sign(builder.unsignedUKIPath, builder.OutUKIPath)
-		if err == nil {
-			slog.Info(fmt.Sprintf("Signed UKI at %s", builder.OutUKIPath))
-		}
-	} else {
-		// Move it to final place as we will remove the scratch dir
-		fileRead, err := os.ReadFile(builder.unsignedUKIPath)
+		uki, err = builder.SecureBootSigner.SignData(uki)
 		if err != nil {
-			return err
+			return fmt.Errorf("error signing UKI: %w", err)
+		}
+	}
+
+	_, err = w.Write(uki)
+
+	return err
+}
+
+// initSigners creates the PCR and SecureBoot signers out of the given keys, unless they were given.
+func (builder *Builder) initSigners() error {
+	if builder.PCRSigner == nil {
+		if builder.PCRKey != "" {
+			signer, err := pesign.NewPCRSigner(builder.PCRKey)
+			if err != nil {
+				return err
+			}
+			builder.PCRSigner = signer
+		}
+	}
+
+	// Try to generate a signer base on our given args
+	// If we have a	either a signer or key/cert
+	// Try to use first the signer as we can use a custom signed passed in the struct
+	// otherwise create a new default signer with the key and cert
+	if builder.sbSignEnabled() {
+		if builder.SecureBootSigner == nil {
+			if builder.SBCert != "" && builder.SBKey != "" {
+				sbSigner, err := newSecureBootSigner(builder.SBCert, builder.SBKey)
+				if err != nil {
+					return err
+				}
+				builder.SecureBootSigner = sbSigner
+			}
 		}
-		err = os.WriteFile(strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1), fileRead, os.ModePerm)
+	}
+
+	return nil
+}
+
+// newSecureBootSigner creates a SecureBoot signer out of the certificate and key.
+func newSecureBootSigner(certPath, keyPath string) (*pesign.Signer, error) {
+	sb, err := pesign.NewSecureBootSigner(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return pesign.NewSigner(sb)
+}
+
+// readInputs reads the sd-stub, kernel and initrd into memory.
+func (builder *Builder) readInputs() error {
+	var err error
+
+	if err = builder.defaultSdStub(); err != nil {
+		return err
+	}
+
+	if builder.stubData, err = readInput(builder.SdStub, builder.SdStubPath); err != nil {
+		return fmt.Errorf("error reading sd-stub: %w", err)
+	}
+
+	if builder.kernelData, err = readInput(builder.Kernel, builder.KernelPath); err != nil {
+		return fmt.Errorf("error reading kernel: %w", err)
+	}
+
+	return builder.readInitrds()
+}
+
+// readInitrds concatenates the initrds in order, each one starting 4 bytes aligned as the kernel
+// expects concatenated cpio archives to be.
+func (builder *Builder) readInitrds() error {
+	builder.initrdData = nil
+
+	if builder.Initrd == nil && builder.InitrdPath == "" && len(builder.InitrdPaths) == 0 {
+		return errors.New("no initrd given")
+	}
+
+	inputs := builder.InitrdPaths
+	if builder.Initrd != nil || builder.InitrdPath != "" {
+		inputs = append([]string{builder.InitrdPath}, inputs...)
+	}
+
+	for i, path := range inputs {
+		var r io.Reader
+		if i == 0 && builder.Initrd != nil {
+			r = builder.Initrd
+		}
+
+		data, err := readInput(r, path)
 		if err != nil {
-			return err
+			return fmt.Errorf("error reading initrd: %w", err)
 		}
-		slog.Info(fmt.Sprintf("Unsigned UKI at %s", strings.Replace(builder.OutUKIPath, "signed", "unsigned", -1)))
+
+		slog.Debug("Read initrd", "path", path, "size", len(data))
+
+		builder.initrdData = appendAligned(builder.initrdData, data)
 	}
 
-	return err
+	return nil
+}
+
+// appendAligned appends the initrd segment to data, padded to start 4 bytes aligned.
+func appendAligned(data, segment []byte) []byte {
+	data = append(data, make([]byte, alignUp(uint64(len(data)), 4)-uint64(len(data)))...)
+
+	return append(data, segment...)
+}
+
+// readInput reads r if given, or the file at path otherwise.
+func readInput(r io.Reader, path string) ([]byte, error) {
+	if r != nil {
+		return io.ReadAll(r)
+	}
+
+	return os.ReadFile(path)
+}
+
+// StubInfo returns the sd-stub detected by Build, or nil if Build was not called yet.
+func (builder *Builder) StubInfo() *StubInfo {
+	return builder.stub
 }
 
 // sbSignEnabled let us know if we have to sign the sd-boot and uki final file
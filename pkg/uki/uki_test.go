@@ -0,0 +1,1482 @@
+package uki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/kairos-io/go-ukify/internal/common"
+	"github.com/kairos-io/go-ukify/pkg/constants"
+	"github.com/kairos-io/go-ukify/pkg/initrd"
+	"github.com/kairos-io/go-ukify/pkg/measure"
+	"github.com/kairos-io/go-ukify/pkg/pesign"
+	"github.com/kairos-io/go-ukify/pkg/types"
+	"github.com/kairos-io/go-ukify/pkg/utils"
+	"github.com/klauspost/compress/zstd"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "UKI test Suite")
+}
+
+// newTestPE builds a minimal PE image with a single .text section for the given machine type.
+// I386 images get a PE32 optional header, everything else a PE32+ one.
+func newTestPE(machine uint16) []byte {
+	var buf bytes.Buffer
+
+	dosHeader := make([]byte, 0x40)
+	copy(dosHeader, "MZ")
+	binary.LittleEndian.PutUint32(dosHeader[0x3c:], 0x40)
+	buf.Write(dosHeader)
+	buf.WriteString("PE\x00\x00")
+
+	var optionalHeader any
+	if machine == pe.IMAGE_FILE_MACHINE_I386 {
+		optionalHeader = &pe.OptionalHeader32{
+			Magic: 0x10b, ImageBase: 0x400000, SectionAlignment: 0x1000, FileAlignment: 0x200,
+			SizeOfImage: 0x2000, SizeOfHeaders: 0x400, Subsystem: pe.IMAGE_SUBSYSTEM_EFI_APPLICATION, NumberOfRvaAndSizes: 16,
+		}
+	} else {
+		optionalHeader = &pe.OptionalHeader64{
+			Magic: 0x20b, ImageBase: 0x10000000, SectionAlignment: 0x1000, FileAlignment: 0x200,
+			SizeOfImage: 0x2000, SizeOfHeaders: 0x400, Subsystem: pe.IMAGE_SUBSYSTEM_EFI_APPLICATION, NumberOfRvaAndSizes: 16,
+		}
+	}
+
+	Expect(binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              machine,
+		NumberOfSections:     1,
+		SizeOfOptionalHeader: uint16(binary.Size(optionalHeader)),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE,
+	})).To(Succeed())
+	Expect(binary.Write(&buf, binary.LittleEndian, optionalHeader)).To(Succeed())
+
+	text := pe.SectionHeader32{
+		VirtualSize: 0x10, VirtualAddress: 0x1000, SizeOfRawData: 0x200, PointerToRawData: 0x400,
+		Characteristics: pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ,
+	}
+	copy(text.Name[:], ".text")
+	Expect(binary.Write(&buf, binary.LittleEndian, text)).To(Succeed())
+
+	buf.Write(make([]byte, 0x600-buf.Len()))
+
+	return buf.Bytes()
+}
+
+// newTestBzImage builds the start of an x86 bzImage with the given boot protocol version and xloadflags.
+func newTestBzImage(version, xloadflags uint16) []byte {
+	data := make([]byte, 0x1000)
+	data[0x1f1] = 4
+	copy(data[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(data[0x206:], version)
+	binary.LittleEndian.PutUint16(data[0x236:], xloadflags)
+
+	return data
+}
+
+// newTestDTB builds a flattened devicetree with a root node carrying the given compatible string.
+func newTestDTB(compatible string) []byte {
+	var dtStruct bytes.Buffer
+
+	u32 := func(v uint32) { Expect(binary.Write(&dtStruct, binary.BigEndian, v)).To(Succeed()) }
+
+	value := append([]byte(compatible), 0)
+	u32(1) // FDT_BEGIN_NODE, with an empty name
+	u32(0)
+	u32(3) // FDT_PROP
+	u32(uint32(len(value)))
+	u32(0)
+	dtStruct.Write(value)
+	dtStruct.Write(make([]byte, alignUp(uint64(len(value)), 4)-uint64(len(value))))
+	u32(2) // FDT_END_NODE
+	u32(9) // FDT_END
+
+	dtStrings := []byte("compatible\x00")
+
+	offStruct := uint32(fdtHeaderSize + 16)
+	offStrings := offStruct + uint32(dtStruct.Len())
+	totalSize := offStrings + uint32(len(dtStrings))
+
+	var dtb bytes.Buffer
+	Expect(binary.Write(&dtb, binary.BigEndian, []uint32{
+		fdtMagic, totalSize, offStruct, offStrings, fdtHeaderSize, fdtVersion, 16, 0, uint32(len(dtStrings)), uint32(dtStruct.Len()),
+	})).To(Succeed())
+	dtb.Write(make([]byte, 16))
+	dtb.Write(dtStruct.Bytes())
+	dtb.Write(dtStrings)
+
+	return dtb.Bytes()
+}
+
+var _ = Describe("UKI tests", func() {
+	Describe("PE image", func() {
+		var stub []byte
+
+		BeforeEach(func() {
+			var err error
+			stub, err = os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Appends sections after the existing ones", func() {
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+			originalSections := len(img.sections)
+
+			_, err = img.appendSection(string(constants.CMDLine), []byte("console=ttyS0"), sectionCharacteristics(constants.CMDLine))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = img.appendSection(string(constants.Linux), bytes.Repeat([]byte{0xaa}, 1000), sectionCharacteristics(constants.Linux))
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := img.Bytes()
+			Expect(err).ToNot(HaveOccurred())
+
+			peFile, err := pe.NewFile(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+
+			Expect(peFile.Sections).To(HaveLen(originalSections + 2))
+
+			cmdline := peFile.Sections[originalSections]
+			Expect(cmdline.Name).To(Equal(".cmdline"))
+			Expect(cmdline.Characteristics).To(Equal(uint32(pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ)))
+			content, err := cmdline.Data()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(content[:cmdline.VirtualSize]).To(Equal([]byte("console=ttyS0")))
+
+			linux := peFile.Sections[originalSections+1]
+			Expect(linux.Name).To(Equal(".linux"))
+			Expect(linux.Characteristics & pe.IMAGE_SCN_CNT_CODE).ToNot(BeZero())
+			Expect(linux.VirtualAddress).To(BeNumerically(">=", cmdline.VirtualAddress+cmdline.VirtualSize))
+			Expect(linux.Offset).To(BeNumerically(">=", cmdline.Offset+cmdline.Size))
+			content, err = linux.Data()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(content[:linux.VirtualSize]).To(Equal(bytes.Repeat([]byte{0xaa}, 1000)))
+
+			header := peFile.OptionalHeader.(*pe.OptionalHeader64)
+			for _, section := range []*pe.Section{cmdline, linux} {
+				Expect(section.VirtualAddress % header.SectionAlignment).To(BeZero())
+				Expect(section.Offset % header.FileAlignment).To(BeZero())
+				Expect(section.Size % header.FileAlignment).To(BeZero())
+			}
+			Expect(header.SizeOfImage % header.SectionAlignment).To(BeZero())
+			Expect(header.SizeOfImage).To(BeNumerically(">=", linux.VirtualAddress+linux.VirtualSize))
+		})
+
+		It("Replaces sections in place", func() {
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+			originalSections := len(img.sections)
+
+			_, err = img.replaceSection(string(constants.SBAT), []byte("sbat,1\n"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = img.replaceSection(string(constants.SBAT), bytes.Repeat([]byte{'a'}, 0x201))
+			Expect(err).To(MatchError(ContainSubstring("not enough space")))
+			_, err = img.replaceSection(string(constants.Profile), nil)
+			Expect(err).To(MatchError(ContainSubstring("not found")))
+
+			data, err := img.Bytes()
+			Expect(err).ToNot(HaveOccurred())
+
+			peFile, err := pe.NewFile(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+
+			Expect(peFile.Sections).To(HaveLen(originalSections))
+			content, err := sectionContent(peFile, string(constants.SBAT))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal("sbat,1\n"))
+		})
+
+		It("Fails when there is no room left for section headers", func() {
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+
+			for {
+				_, err = img.appendSection(".extra", []byte("data"), sectionCharacteristics(".extra"))
+				if err != nil {
+					break
+				}
+			}
+			Expect(err).To(MatchError(ContainSubstring("not enough header space")))
+		})
+
+		It("Grows the headers into the unused space before the first section", func() {
+			stub := newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)
+
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+
+			// move the .text data to 0x1000, leaving 0x400 to 0x1000 free for the headers
+			binary.LittleEndian.PutUint32(stub[img.sectionTableOffset+20:], 0x1000)
+			stub = append(stub, make([]byte, 0x1200-len(stub))...)
+
+			img, err = newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(img.maxSizeOfHeaders).To(Equal(uint32(0x1000)))
+
+			// fill the section table up to 0x400, .text included
+			for range (0x400-img.sectionTableOffset)/sectionHeaderSize - 1 {
+				_, err = img.appendSection(".extra", []byte("data"), sectionCharacteristics(".extra"))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(img.sizeOfHeaders).To(Equal(uint32(0x400)))
+
+			_, err = img.appendSection(".extra", []byte("data"), sectionCharacteristics(".extra"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(img.sizeOfHeaders).To(Equal(uint32(0x600)))
+
+			data, err := img.Bytes()
+			Expect(err).ToNot(HaveOccurred())
+
+			peFile, err := pe.NewFile(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+
+			Expect(peFile.OptionalHeader.(*pe.OptionalHeader64).SizeOfHeaders).To(Equal(uint32(0x600)))
+			content, err := sectionContent(peFile, ".text")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(content).To(HaveLen(0x10))
+		})
+
+		It("Rejects stubs with an invalid alignment", func() {
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+
+			// FileAlignment lives right after SectionAlignment in the optional header
+			binary.LittleEndian.PutUint32(stub[img.optionalHeaderOffset+36:], 0x300)
+
+			_, err = newPEImage(stub)
+			Expect(err).To(MatchError(ContainSubstring("invalid PE alignment")))
+		})
+
+		It("Rejects signed stubs", func() {
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+
+			// the certificate table is the 5th data directory, after 112 bytes of PE32+ optional header fields
+			binary.LittleEndian.PutUint32(stub[img.optionalHeaderOffset+112+4*8+4:], 0x100)
+
+			_, err = newPEImage(stub)
+			Expect(err).To(MatchError(ContainSubstring("signed")))
+		})
+
+		It("Appends sections to a PE32 (ia32) image", func() {
+			img, err := newPEImage(newTestPE(pe.IMAGE_FILE_MACHINE_I386))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(img.imageBase).To(Equal(uint64(0x400000)))
+
+			rva, err := img.appendSection(string(constants.Initrd), []byte("initrd"), sectionCharacteristics(constants.Initrd))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rva).To(Equal(uint32(0x2000)))
+
+			data, err := img.Bytes()
+			Expect(err).ToNot(HaveOccurred())
+
+			peFile, err := pe.NewFile(bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+
+			Expect(peFile.Sections).To(HaveLen(2))
+			header, ok := peFile.OptionalHeader.(*pe.OptionalHeader32)
+			Expect(ok).To(BeTrue())
+			Expect(header.SizeOfImage).To(Equal(uint32(0x3000)))
+		})
+
+		It("Computes the PE checksum", func() {
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+
+			// precalculated with the pefile generate_checksum() algorithm
+			Expect(peChecksum(stub, img.optionalHeaderOffset+optCheckSum)).To(Equal(uint32(0x22e33)))
+		})
+
+		It("Rejects section names longer than 8 bytes", func() {
+			img, err := newPEImage(stub)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = img.appendSection(".toolongname", []byte("data"), sectionCharacteristics(".toolongname"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("CheckKernelIA32Entry", func() {
+		var tmpDir string
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(tmpDir)).ToNot(HaveOccurred())
+		})
+
+		It("Accepts kernels with the 32-bit EFI handover entry", func() {
+			kernel := filepath.Join(tmpDir, "kernel")
+			Expect(os.WriteFile(kernel, newTestBzImage(0x020f, xlfEFIHandover32), 0o600)).To(Succeed())
+			Expect(CheckKernelIA32Entry(kernel)).To(Succeed())
+		})
+
+		It("Rejects kernels without a 32-bit entry", func() {
+			kernel := filepath.Join(tmpDir, "kernel")
+			Expect(os.WriteFile(kernel, newTestBzImage(0x020f, 0), 0o600)).To(Succeed())
+			Expect(CheckKernelIA32Entry(kernel)).To(MatchError(ContainSubstring("32-bit")))
+		})
+
+		It("Rejects non x86 kernels", func() {
+			kernel := filepath.Join(tmpDir, "kernel")
+			Expect(os.WriteFile(kernel, make([]byte, 0x1000), 0o600)).To(Succeed())
+			Expect(CheckKernelIA32Entry(kernel)).To(MatchError(ContainSubstring("bzImage")))
+		})
+	})
+
+	Describe("Arch", func() {
+		It("Resolves arch aliases", func() {
+			arch, err := LookupArch("arm64")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(arch.Name).To(Equal("aarch64"))
+			Expect(arch.DefaultSdStubPath()).To(Equal("/usr/lib/systemd/boot/efi/linuxaa64.efi.stub"))
+
+			_, err = LookupArch("sparc64")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Detects the arch from the sd-stub", func() {
+			builder := &Builder{stubData: newTestPE(pe.IMAGE_FILE_MACHINE_RISCV64)}
+			Expect(builder.resolveArch()).To(Succeed())
+			Expect(builder.arch.Name).To(Equal("riscv64"))
+		})
+
+		It("Defaults the sd-stub for the arch", func() {
+			builder := &Builder{Arch: "arm64"}
+			Expect(builder.defaultSdStub()).To(Succeed())
+			Expect(builder.SdStubPath).To(Equal("/usr/lib/systemd/boot/efi/linuxaa64.efi.stub"))
+
+			builder = &Builder{Arch: "arm64", SdStub: bytes.NewReader(nil)}
+			Expect(builder.defaultSdStub()).To(Succeed())
+			Expect(builder.SdStubPath).To(BeEmpty())
+		})
+
+		It("Rejects mismatched sd-stub and kernel", func() {
+			stub := newTestPE(pe.IMAGE_FILE_MACHINE_ARM64)
+			kernel := newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)
+
+			builder := &Builder{stubData: stub, kernelData: kernel}
+			Expect(builder.resolveArch()).To(Succeed())
+			Expect(builder.checkArch()).To(MatchError(ContainSubstring("cannot be booted on aarch64")))
+
+			builder = &Builder{Arch: "x86_64", stubData: stub, kernelData: kernel}
+			Expect(builder.resolveArch()).To(Succeed())
+			Expect(builder.checkArch()).To(MatchError(ContainSubstring("sd-stub")))
+		})
+
+		It("Accepts matching sd-stub and kernel", func() {
+			builder := &Builder{Arch: "arm64", stubData: newTestPE(pe.IMAGE_FILE_MACHINE_ARM64), kernelData: newTestPE(pe.IMAGE_FILE_MACHINE_ARM64)}
+			Expect(builder.resolveArch()).To(Succeed())
+			Expect(builder.checkArch()).To(Succeed())
+		})
+	})
+
+	Describe("DiscoverKernelVersion", func() {
+		It("Finds the version in the Linux banner of non x86 kernels", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			kernel := append(newTestPE(pe.IMAGE_FILE_MACHINE_ARM64), []byte("Linux version %s\x00Linux version 6.6.1-kairos (builder@host) #1 SMP\x00")...)
+			Expect(os.WriteFile(filepath.Join(tmpDir, "Image"), kernel, 0o600)).To(Succeed())
+
+			version, err := DiscoverKernelVersion(filepath.Join(tmpDir, "Image"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version).To(Equal("6.6.1-kairos"))
+		})
+
+		const banner = "Linux version 6.6.1-kairos (builder@host) #1 SMP\x00"
+
+		DescribeTable("Decompresses EFI zboot kernels",
+			func(compression string, compress func([]byte) []byte) {
+				image := append(newTestPE(pe.IMAGE_FILE_MACHINE_ARM64), []byte(banner)...)
+				payload := compress(image)
+
+				kernel := make([]byte, zbootHeaderSize, zbootHeaderSize+len(payload))
+				copy(kernel, "MZ")
+				copy(kernel[4:], zbootMagic)
+				binary.LittleEndian.PutUint32(kernel[8:], zbootHeaderSize)
+				binary.LittleEndian.PutUint32(kernel[12:], uint32(len(payload)))
+				copy(kernel[zbootCompressionOffset:], compression)
+				kernel = append(kernel, payload...)
+
+				version, err := discoverKernelVersion(kernel)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(version).To(Equal("6.6.1-kairos"))
+			},
+			Entry("gzip", "gzip", func(data []byte) []byte {
+				var compressed bytes.Buffer
+				zw := gzip.NewWriter(&compressed)
+				_, err := zw.Write(data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(zw.Close()).To(Succeed())
+
+				return compressed.Bytes()
+			}),
+			Entry("zstd", "zstd22", func(data []byte) []byte {
+				zw, err := zstd.NewWriter(nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				return zw.EncodeAll(data, nil)
+			}),
+		)
+
+		It("Refuses unsupported zboot compressions", func() {
+			kernel := make([]byte, zbootHeaderSize)
+			copy(kernel, "MZ")
+			copy(kernel[4:], zbootMagic)
+			copy(kernel[zbootCompressionOffset:], "lzma")
+
+			_, err := discoverKernelVersion(kernel)
+			Expect(err).To(MatchError(`unsupported zboot compression "lzma"`))
+		})
+
+		It("Finds the version in the read-only data of vmlinux files", func() {
+			strtab := []byte("\x00.rodata\x00.shstrtab\x00")
+			rodata := []byte("Linux version %s\x00" + banner)
+			shoff := 64 + len(rodata) + len(strtab)
+
+			var vmlinux bytes.Buffer
+			header := elf.Header64{
+				Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_AARCH64), Version: uint32(elf.EV_CURRENT),
+				Shoff: uint64(shoff), Ehsize: 64, Shentsize: 64, Shnum: 3, Shstrndx: 2,
+			}
+			copy(header.Ident[:], elf.ELFMAG)
+			header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+			header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+			header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+			Expect(binary.Write(&vmlinux, binary.LittleEndian, header)).To(Succeed())
+			vmlinux.Write(rodata)
+			vmlinux.Write(strtab)
+			Expect(binary.Write(&vmlinux, binary.LittleEndian, []elf.Section64{
+				{},
+				{Name: 1, Type: uint32(elf.SHT_PROGBITS), Off: 64, Size: uint64(len(rodata))},
+				{Name: 9, Type: uint32(elf.SHT_STRTAB), Off: uint64(64 + len(rodata)), Size: uint64(len(strtab))},
+			})).To(Succeed())
+
+			version, err := discoverKernelVersion(vmlinux.Bytes())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(version).To(Equal("6.6.1-kairos"))
+		})
+
+		It("Falls back to the modules of the initrd", func() {
+			stub, err := os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			var base, modules bytes.Buffer
+			Expect(initrd.Build(&base, fstest.MapFS{"init": {Data: []byte("#!/bin/sh\n"), Mode: 0o755}}, initrd.Options{})).To(Succeed())
+			Expect(initrd.Build(&modules, fstest.MapFS{
+				"usr/lib/modules/6.6.1-kairos/modules.dep": {Data: []byte{}, Mode: 0o644},
+			}, initrd.Options{Gzip: true})).To(Succeed())
+
+			builder := &Builder{
+				SdStub: bytes.NewReader(stub),
+				Kernel: bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+				Initrd: bytes.NewReader(append(base.Bytes(), modules.Bytes()...)),
+			}
+			Expect(builder.BuildTo(&bytes.Buffer{})).To(Succeed())
+
+			sectionsContent, err := utils.SectionsContent(builder.sections)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(sectionsContent[constants.Uname])).To(Equal("6.6.1-kairos"))
+
+			// the given uname takes precedence
+			builder.SdStub = bytes.NewReader(stub)
+			builder.Kernel = bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64))
+			builder.Initrd = bytes.NewReader(base.Bytes())
+			builder.Uname = "6.6.2-custom"
+			Expect(builder.BuildTo(&bytes.Buffer{})).To(Succeed())
+
+			sectionsContent, err = utils.SectionsContent(builder.sections)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(sectionsContent[constants.Uname])).To(Equal("6.6.2-custom"))
+		})
+	})
+
+	Describe("Reproducible builds", func() {
+		var stub []byte
+
+		BeforeEach(func() {
+			var err error
+			stub, err = os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		assemble := func(epoch int64) []byte {
+			builder := &Builder{
+				SourceDateEpoch: epoch,
+				stubData:        stub,
+				sections: []types.UkiSection{
+					{Name: constants.CMDLine, Data: []byte("console=ttyS0"), Append: true},
+				},
+			}
+			data, err := builder.assemble()
+			Expect(err).ToNot(HaveOccurred())
+
+			return data
+		}
+
+		It("Produces identical UKIs from identical inputs", func() {
+			first := assemble(1700000000)
+			Expect(assemble(1700000000)).To(Equal(first))
+
+			peFile, err := pe.NewFile(bytes.NewReader(first))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+			Expect(peFile.FileHeader.TimeDateStamp).To(Equal(uint32(1700000000)))
+
+			header := peFile.OptionalHeader.(*pe.OptionalHeader64)
+			img, err := newPEImage(first)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(header.CheckSum).To(Equal(peChecksum(first, img.optionalHeaderOffset+optCheckSum)))
+		})
+
+		It("Honors SOURCE_DATE_EPOCH", func() {
+			GinkgoT().Setenv("SOURCE_DATE_EPOCH", "1234")
+
+			peFile, err := pe.NewFile(bytes.NewReader(assemble(0)))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+			Expect(peFile.FileHeader.TimeDateStamp).To(Equal(uint32(1234)))
+		})
+	})
+
+	Describe("BuildTo", func() {
+		It("Builds a UKI from readers", func() {
+			stub, err := os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{
+				Cmdline: "console=ttyS0",
+				SdStub:  bytes.NewReader(stub),
+				Kernel:  bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+				Initrd:  bytes.NewReader([]byte("initrd")),
+			}
+
+			var uki bytes.Buffer
+			Expect(builder.BuildTo(&uki)).To(Succeed())
+
+			peFile, err := pe.NewFile(bytes.NewReader(uki.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+
+			cmdline, err := sectionContent(peFile, string(constants.CMDLine))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(cmdline)).To(Equal("console=ttyS0"))
+
+			initrd, err := sectionContent(peFile, string(constants.Initrd))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(initrd)).To(Equal("initrd"))
+
+			Expect(peFile.Sections[len(peFile.Sections)-1].Name).To(Equal(string(constants.Linux)))
+		})
+
+		It("Concatenates the initrds, 4 bytes aligned", func() {
+			stub, err := os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			var overlays []string
+			for _, overlay := range []string{"firmware", "config"} {
+				path := filepath.Join(tmpDir, overlay)
+				Expect(os.WriteFile(path, []byte(overlay), 0o600)).To(Succeed())
+				overlays = append(overlays, path)
+			}
+
+			builder := &Builder{
+				SdStub:      bytes.NewReader(stub),
+				Kernel:      bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+				Initrd:      bytes.NewReader([]byte("initrd")),
+				InitrdPaths: overlays,
+			}
+
+			var uki bytes.Buffer
+			Expect(builder.BuildTo(&uki)).To(Succeed())
+
+			peFile, err := pe.NewFile(bytes.NewReader(uki.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+
+			initrd, err := sectionContent(peFile, string(constants.Initrd))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(initrd)).To(Equal("initrd\x00\x00firmwareconfig"))
+
+			// what is measured is what the stub passes to the kernel
+			sectionsContent, err := utils.SectionsContent(builder.sections)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sectionsContent[constants.Initrd]).To(Equal(initrd))
+		})
+
+		It("Needs an initrd", func() {
+			stub, err := os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{
+				SdStub: bytes.NewReader(stub),
+				Kernel: bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+			}
+			Expect(builder.BuildTo(&bytes.Buffer{})).To(MatchError("no initrd given"))
+		})
+	})
+
+	Describe("Extra sections", func() {
+		var stub []byte
+
+		BeforeEach(func() {
+			var err error
+			stub, err = os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Parses NAME:PATH[:measure]", func() {
+			section, err := ParseSection(".kairos:/tmp/a:b")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(section).To(Equal(types.UkiSection{Name: ".kairos", Path: "/tmp/a:b", Append: true}))
+
+			section, err = ParseSection(".dtb:board.dtb:measure")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(section).To(Equal(types.UkiSection{Name: constants.DTB, Path: "board.dtb", Measure: true, Append: true}))
+
+			_, err = ParseSection(".kairos")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Appends valid sections", func() {
+			builder := &Builder{stubData: stub, ExtraSections: []types.UkiSection{
+				{Name: ".kairos", Data: []byte("{}")},
+				{Name: constants.DTB, Data: []byte("dtb"), Measure: true},
+			}}
+			Expect(builder.generateExtraSections()).To(Succeed())
+			Expect(builder.sections).To(HaveLen(2))
+			Expect(builder.sections[0].Append).To(BeTrue())
+		})
+
+		It("Rejects sections given twice", func() {
+			builder := &Builder{stubData: stub, ExtraSections: []types.UkiSection{
+				{Name: ".kairos", Data: []byte("{}")},
+				{Name: ".kairos", Data: []byte("{}")},
+			}}
+			Expect(builder.generateExtraSections()).To(MatchError("extra section .kairos is given twice"))
+
+			builder = &Builder{stubData: stub, ExtraSections: []types.UkiSection{
+				{Name: constants.DTB, Data: []byte("dtb"), Measure: true},
+				{Name: constants.DTB, Data: []byte("dtb"), Measure: true},
+			}}
+			Expect(builder.generateExtraSections()).To(MatchError("extra section .dtb is given twice"))
+			Expect(builder.sections).To(BeEmpty())
+		})
+
+		DescribeTable("Rejects invalid sections",
+			func(section types.UkiSection, message string) {
+				builder := &Builder{
+					stubData:      stub,
+					sections:      []types.UkiSection{{Name: constants.CMDLine, Append: true}},
+					ExtraSections: []types.UkiSection{section},
+				}
+				Expect(builder.generateExtraSections()).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("too long", types.UkiSection{Name: ".kairosmeta"}, "longer than the 8 bytes"),
+			Entry("managed", types.UkiSection{Name: constants.PCRSig}, "managed by the builder"),
+			Entry("generated", types.UkiSection{Name: constants.CMDLine, Measure: true}, "already generated"),
+			Entry("in the stub", types.UkiSection{Name: ".sdmagic"}, "part of the sd-stub"),
+			Entry("measured custom", types.UkiSection{Name: ".kairos", Measure: true}, "cannot be measured"),
+			Entry("unmeasured systemd", types.UkiSection{Name: constants.DTB}, "has to be marked as measured"),
+		)
+	})
+
+	Describe("Devicetree", func() {
+		It("Accepts a valid devicetree", func() {
+			Expect(ValidateDTB(newTestDTB("acme,board"))).To(Succeed())
+		})
+
+		It("Rejects invalid devicetrees", func() {
+			dtb := newTestDTB("acme,board")
+			Expect(ValidateDTB(dtb[:20])).To(MatchError(ContainSubstring("too short")))
+			Expect(ValidateDTB(dtb[:len(dtb)-1])).To(MatchError(ContainSubstring("total size")))
+			Expect(ValidateDTB(newTestPE(pe.IMAGE_FILE_MACHINE_ARM64))).To(MatchError(ContainSubstring("FDT magic")))
+		})
+
+		It("Embeds the devicetree as a measured section", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			path := filepath.Join(tmpDir, "board.dtb")
+			Expect(os.WriteFile(path, newTestDTB("acme,board"), 0o600)).To(Succeed())
+
+			builder := &Builder{DevicetreePath: path}
+			Expect(builder.generateDTB()).To(Succeed())
+			Expect(builder.sections).To(Equal([]types.UkiSection{
+				{Name: constants.DTB, Data: newTestDTB("acme,board"), Measure: true, Append: true},
+			}))
+		})
+	})
+
+	Describe("os-release", func() {
+		It("Generates an os-release with the given fields", func() {
+			builder := &Builder{Version: "v3.2.1", ImageID: "kairos-ubuntu", ImageVersion: "3.2.1", BuildID: "2024-10-01", VariantID: "core", SysextLevel: "1.0"}
+			Expect(builder.generateOSRel()).To(Succeed())
+			Expect(builder.sections).To(HaveLen(1))
+			Expect(string(builder.sections[0].Data)).To(Equal(`NAME=Kairos
+ID=kairos
+PRETTY_NAME="Kairos (v3.2.1)"
+VERSION=v3.2.1
+VERSION_ID=v3.2.1
+IMAGE_ID=kairos-ubuntu
+IMAGE_VERSION=3.2.1
+BUILD_ID=2024-10-01
+VARIANT_ID=core
+SYSEXT_LEVEL=1.0
+`))
+			Expect(ValidateOSRelease(builder.sections[0].Data)).To(Succeed())
+		})
+
+		It("Derives a valid VERSION_ID from the version", func() {
+			builder := &Builder{Version: "v3.2.1+K3s1 RC~1"}
+			Expect(builder.generateOSRel()).To(Succeed())
+			Expect(string(builder.sections[0].Data)).To(ContainSubstring("\nVERSION=\"v3.2.1+K3s1 RC~1\"\nVERSION_ID=v3.2.1-k3s1-rc-1\n"))
+			Expect(ValidateOSRelease(builder.sections[0].Data)).To(Succeed())
+		})
+
+		It("Merges the given fields into an existing os-release", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			path := filepath.Join(tmpDir, "os-release")
+			existing := "# Kairos\nNAME='Kairos'\nID=kairos\nIMAGE_VERSION=\"3.0.0\"\nHOME_URL=\"https://kairos.io\"\n"
+			Expect(os.WriteFile(path, []byte(existing), 0o600)).To(Succeed())
+
+			// the file is embedded as is, without fields to merge
+			builder := &Builder{OsRelease: path}
+			Expect(builder.generateOSRel()).To(Succeed())
+			Expect(string(builder.sections[0].Data)).To(Equal(existing))
+
+			builder = &Builder{OsRelease: path, ImageVersion: "3.2.1", VariantID: "standard"}
+			Expect(builder.generateOSRel()).To(Succeed())
+			Expect(string(builder.sections[0].Data)).To(Equal("# Kairos\nNAME='Kairos'\nID=kairos\nIMAGE_VERSION=3.2.1\nHOME_URL=\"https://kairos.io\"\nVARIANT_ID=standard\n"))
+		})
+
+		It("Quotes values when needed", func() {
+			Expect(formatOSReleaseField("PRETTY_NAME", `Kairos "$edge"`)).To(Equal(`PRETTY_NAME="Kairos \"\$edge\""`))
+
+			field, ok, err := parseOSReleaseLine(`PRETTY_NAME="Kairos \"\$edge\""`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(field.value).To(Equal(`Kairos "$edge"`))
+		})
+
+		DescribeTable("Rejects invalid os-release files",
+			func(osRelease, message string) {
+				Expect(ValidateOSRelease([]byte(osRelease))).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("without assignment", "NAME=Kairos\nKairos\n", "expected KEY=VALUE"),
+			Entry("with an invalid key", "NAME=Kairos\n1NAME=Kairos\n", "expected KEY=VALUE"),
+			Entry("with an unquoted space", "NAME=Kairos Linux\n", "must be quoted"),
+			Entry("with an unterminated quote", "NAME=\"Kairos\n", "unterminated double quoted value"),
+			Entry("with trailing characters", "NAME=\"Kairos\" Linux\n", "trailing characters"),
+			Entry("with an unescaped dollar", "NAME=\"$Kairos\"\n", "unescaped $"),
+			Entry("with an upper case ID", "ID=Kairos\n", "may only have lower case letters"),
+			Entry("with a BUILD_ID with spaces", "ID=kairos\nBUILD_ID=\"2024 10\"\n", "may not have spaces"),
+			Entry("without a name", "VERSION_ID=3.2.1\n", "none of PRETTY_NAME, NAME, ID or IMAGE_ID"),
+		)
+	})
+
+	Describe("Cmdline", func() {
+		It("Reads cmdline files like /etc/kernel/cmdline", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			path := filepath.Join(tmpDir, "cmdline")
+			Expect(os.WriteFile(path, []byte("# root\nroot=LABEL=COS_STATE  rd.neednet=0\n\n  console=tty1\n"), 0o600)).To(Succeed())
+
+			cmdline, err := ReadCmdline(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cmdline).To(Equal("root=LABEL=COS_STATE  rd.neednet=0 console=tty1"))
+		})
+
+		It("Renders os-release fields, the version and the arch", func() {
+			builder := &Builder{Version: "v3.2.1", ImageVersion: "3.2.1", arch: architectures["x86_64"]}
+			Expect(builder.generateOSRel()).To(Succeed())
+
+			cmdline, err := builder.resolveCmdline("kairos.version={{ .OSRelease.IMAGE_VERSION }} {{ .Version }} {{ .Arch }} ")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cmdline).To(Equal("kairos.version=3.2.1 v3.2.1 x86_64"))
+
+			_, err = builder.resolveCmdline("{{ .OSRelease.VARIANT_ID }}")
+			Expect(err).To(MatchError(ContainSubstring("error rendering cmdline")))
+		})
+
+		DescribeTable("Rejects invalid cmdlines",
+			func(arch, cmdline, message string) {
+				resolved, err := LookupArch(arch)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(validateCmdline(cmdline, resolved)).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("too long for x86_64", "x86_64", strings.Repeat("a", 2048), "only accepts up to 2047"),
+			Entry("too long for riscv64", "riscv64", strings.Repeat("a", 1024), "only accepts up to 1023"),
+			Entry("with a newline", "x86_64", "quiet\nsplash", "invalid character"),
+			Entry("with a tab", "x86_64", "quiet\tsplash", "invalid character"),
+			Entry("with invalid UTF-8", "x86_64", "quiet \xff", "not valid UTF-8"),
+			Entry("with an unterminated quote", "x86_64", `dyndbg="file x.c +p`, "unterminated double quote"),
+		)
+
+		It("Omits the .cmdline section if the cmdline is empty", func() {
+			builder := &Builder{}
+			Expect(builder.generateCmdline()).To(Succeed())
+			Expect(builder.sections).To(BeEmpty())
+		})
+	})
+
+	Describe("SBAT", func() {
+		const kairosSBAT = "kairos,1,Kairos,kairos,1,https://kairos.io\n"
+
+		var stub []byte
+
+		BeforeEach(func() {
+			var err error
+
+			stub, err = os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Merges extra entries into the .sbat section of the sd-stub", func() {
+			builder := &Builder{
+				SdStub: bytes.NewReader(stub),
+				Kernel: bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+				Initrd: bytes.NewReader([]byte("initrd")),
+				SBAT:   kairosSBAT,
+			}
+
+			var uki bytes.Buffer
+			Expect(builder.BuildTo(&uki)).To(Succeed())
+
+			peFile, err := pe.NewFile(bytes.NewReader(uki.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			defer peFile.Close()
+
+			stubSBAT, err := GetSBAT("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			sbat, err := getSBAT(peFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sbat).To(Equal(mergeSBAT(stubSBAT, []byte(kairosSBAT))))
+			Expect(string(sbat)).To(HaveSuffix("\n" + kairosSBAT))
+			Expect(bytes.Count(sbat, []byte("\nsystemd,"))).To(Equal(1))
+
+			sbatSections := 0
+			for _, section := range peFile.Sections {
+				if section.Name == string(constants.SBAT) {
+					sbatSections++
+				}
+			}
+			Expect(sbatSections).To(Equal(1))
+
+			// the merged SBAT is the one measured
+			sectionsContent, err := utils.SectionsContent(builder.sections)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sectionsContent[constants.SBAT]).To(Equal(sbat))
+		})
+
+		It("Rejects invalid entries", func() {
+			builder := &Builder{
+				SdStub: bytes.NewReader(stub),
+				Kernel: bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+				Initrd: bytes.NewReader([]byte("initrd")),
+				SBAT:   "kairos,one,Kairos\n",
+			}
+			Expect(builder.BuildTo(&bytes.Buffer{})).To(MatchError(ContainSubstring("invalid SBAT")))
+		})
+
+		It("Fails if the entries do not fit in the .sbat section of the sd-stub", func() {
+			builder := &Builder{
+				SdStub: bytes.NewReader(stub),
+				Kernel: bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+				Initrd: bytes.NewReader([]byte("initrd")),
+				SBAT:   strings.Repeat(kairosSBAT, 10),
+			}
+			Expect(builder.BuildTo(&bytes.Buffer{})).To(MatchError(ContainSubstring("not enough space to replace section .sbat")))
+		})
+	})
+
+	Describe("Splash", func() {
+		var tmpDir string
+
+		BeforeEach(func() {
+			var err error
+
+			tmpDir, err = os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+		})
+
+		It("Accepts the bundled logo", func() {
+			width, height, err := ValidateBMP(common.Logo)
+			Expect(err).ToNot(HaveOccurred())
+			Expect([]int{width, height}).To(Equal([]int{640, 480}))
+		})
+
+		It("Converts PNG images to 24-bit BMP", func() {
+			img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+			img.Set(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+			img.Set(1, 0, color.NRGBA{G: 0xff, A: 0xff})
+			img.Set(2, 0, color.NRGBA{B: 0xff, A: 0x80})
+			img.Set(0, 1, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff})
+
+			var encoded bytes.Buffer
+			Expect(png.Encode(&encoded, img)).To(Succeed())
+			path := filepath.Join(tmpDir, "splash.png")
+			Expect(os.WriteFile(path, encoded.Bytes(), 0o600)).To(Succeed())
+
+			bmp, err := readSplash(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			width, height, err := ValidateBMP(bmp)
+			Expect(err).ToNot(HaveOccurred())
+			Expect([]int{width, height}).To(Equal([]int{3, 2}))
+			Expect(binary.LittleEndian.Uint16(bmp[28:])).To(Equal(uint16(24)))
+
+			// bottom-up BGR rows, padded to 4 bytes, with the transparent pixel over black
+			Expect(bmp[bmpFileHeaderSize+bmpInfoHeaderSize:]).To(Equal([]byte{
+				0x30, 0x20, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0xff, 0, 0xff, 0, 0x80, 0, 0, 0, 0, 0,
+			}))
+		})
+
+		It("Converts JPEG images to BMP", func() {
+			var encoded bytes.Buffer
+			Expect(jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 16, 8)), nil)).To(Succeed())
+			path := filepath.Join(tmpDir, "splash.jpg")
+			Expect(os.WriteFile(path, encoded.Bytes(), 0o600)).To(Succeed())
+
+			bmp, err := readSplash(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			width, height, err := ValidateBMP(bmp)
+			Expect(err).ToNot(HaveOccurred())
+			Expect([]int{width, height}).To(Equal([]int{16, 8}))
+		})
+
+		It("Rejects unreadable and invalid images", func() {
+			_, err := readSplash(filepath.Join(tmpDir, "missing.bmp"))
+			Expect(err).To(MatchError(ContainSubstring("error reading splash")))
+
+			path := filepath.Join(tmpDir, "splash.gif")
+			Expect(os.WriteFile(path, []byte("GIF89a"), 0o600)).To(Succeed())
+			_, err = readSplash(path)
+			Expect(err).To(MatchError(ContainSubstring("neither a BMP, PNG nor JPEG image")))
+
+			rle := bytes.Clone(common.Logo)
+			binary.LittleEndian.PutUint32(rle[30:], 1)
+			_, _, err = ValidateBMP(rle)
+			Expect(err).To(MatchError(ContainSubstring("unsupported BMP compression 1")))
+
+			_, _, err = ValidateBMP(common.Logo[:1000])
+			Expect(err).To(MatchError(ContainSubstring("extends past its 1000 bytes")))
+		})
+
+		It("Accepts color masks only at 16 and 32 bits per pixel", func() {
+			// the bundled logo is a 32-bit image with color masks
+			Expect(binary.LittleEndian.Uint16(common.Logo[28:])).To(Equal(uint16(32)))
+			Expect(binary.LittleEndian.Uint32(common.Logo[30:])).To(Equal(uint32(3)))
+
+			bitfields := bytes.Clone(common.Logo)
+			binary.LittleEndian.PutUint16(bitfields[28:], 16)
+			_, _, err := ValidateBMP(bitfields)
+			Expect(err).ToNot(HaveOccurred())
+
+			binary.LittleEndian.PutUint16(bitfields[28:], 24)
+			_, _, err = ValidateBMP(bitfields)
+			Expect(err).To(MatchError("splash has color masks at a depth of 24 bits per pixel, they are only supported at 16 and 32"))
+		})
+
+		It("Builds without a splash", func() {
+			builder := &Builder{NoSplash: true}
+			Expect(builder.generateSplash()).To(Succeed())
+			Expect(builder.sections).To(BeEmpty())
+
+			builder = &Builder{NoSplash: true, Splash: "splash.bmp"}
+			Expect(builder.generateSplash()).ToNot(Succeed())
+		})
+	})
+
+	Describe("Credentials and extension images", func() {
+		var tmpDir string
+
+		writeFile := func(name string, data string) string {
+			path := filepath.Join(tmpDir, name)
+			Expect(os.WriteFile(path, []byte(data), 0o600)).To(Succeed())
+
+			return path
+		}
+
+		BeforeEach(func() {
+			var err error
+
+			tmpDir, err = os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+		})
+
+		It("Parses credentials", func() {
+			credential, err := ParseCredential("kairos.config=/tmp/config.cred")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(credential).To(Equal(Credential{Name: "kairos.config", Path: "/tmp/config.cred"}))
+
+			_, err = ParseCredential("kairos.config")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Appends them to the initrd in the /.extra layout", func() {
+			stub, err := os.ReadFile("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{
+				SdStub:      bytes.NewReader(stub),
+				Kernel:      bytes.NewReader(newTestPE(pe.IMAGE_FILE_MACHINE_AMD64)),
+				Initrd:      bytes.NewReader([]byte("initrd")),
+				Credentials: []Credential{{Name: "kairos.config", Path: writeFile("config", "encrypted config")}},
+				Sysexts:     []string{writeFile("tools.sysext.raw", "sysext image")},
+				Confexts:    []string{writeFile("site.confext.raw", "confext image")},
+			}
+
+			Expect(builder.BuildTo(&bytes.Buffer{})).To(Succeed())
+
+			sectionsContent, err := utils.SectionsContent(builder.sections)
+			Expect(err).ToNot(HaveOccurred())
+
+			data := sectionsContent[constants.Initrd]
+			Expect(data[:8]).To(Equal([]byte("initrd\x00\x00")))
+			Expect(initrd.IsCPIO(data[8:])).To(BeTrue())
+
+			// entries come in order, each file after its directory
+			offset := 0
+			for _, entry := range []string{
+				".extra\x00",
+				".extra/credentials\x00",
+				".extra/credentials/kairos.config.cred\x00", "encrypted config",
+				".extra/sysext\x00",
+				".extra/sysext/tools.sysext.raw\x00", "sysext image",
+				".extra/confext\x00",
+				".extra/confext/site.confext.raw\x00", "confext image",
+			} {
+				i := bytes.Index(data[offset:], []byte(entry))
+				Expect(i).To(BeNumerically(">=", 0), entry)
+				offset += i + len(entry)
+			}
+
+			// credentials are only readable by root, unlike extension images
+			files, err := initrd.Files(data[8:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(Equal([]initrd.File{
+				{Name: ".extra", Mode: fs.ModeDir | 0o555},
+				{Name: ".extra/credentials", Mode: fs.ModeDir | 0o500},
+				{Name: ".extra/credentials/kairos.config.cred", Mode: 0o400},
+				{Name: ".extra/sysext", Mode: fs.ModeDir | 0o555},
+				{Name: ".extra/sysext/tools.sysext.raw", Mode: 0o444},
+				{Name: ".extra/confext", Mode: fs.ModeDir | 0o555},
+				{Name: ".extra/confext/site.confext.raw", Mode: 0o444},
+			}))
+		})
+
+		It("Does not add the .cred suffix twice", func() {
+			builder := &Builder{Credentials: []Credential{{Name: "kairos.config.cred", Path: writeFile("config", "encrypted config")}}}
+			files, err := builder.extraFiles()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			Expect(files[0].name).To(Equal("kairos.config.cred"))
+		})
+
+		It("Rejects invalid names", func() {
+			builder := &Builder{Credentials: []Credential{{Name: "../config", Path: "config"}}}
+			_, err := builder.extraInitrd()
+			Expect(err).To(MatchError(ContainSubstring("invalid credential name")))
+
+			builder = &Builder{Sysexts: []string{"tools.img"}}
+			_, err = builder.extraInitrd()
+			Expect(err).To(MatchError(ContainSubstring("has to be a .sysext.raw file")))
+
+			// the image is not renamed, as systemd-sysext matches its name against its extension-release
+			builder = &Builder{Confexts: []string{"site.raw"}}
+			_, err = builder.extraInitrd()
+			Expect(err).To(MatchError("confext image site.raw has to be a .confext.raw file"))
+
+			builder = &Builder{Sysexts: []string{"a/tools.sysext.raw", "b/tools.sysext.raw"}}
+			_, err = builder.extraInitrd()
+			Expect(err).To(MatchError(ContainSubstring(".extra/sysext/tools.sysext.raw is given twice")))
+		})
+	})
+
+	Describe("Microcode", func() {
+		var tmpDir string
+		var x86 Arch
+		var err error
+
+		writeFile := func(name string, data []byte) string {
+			path := filepath.Join(tmpDir, name)
+			Expect(os.WriteFile(path, data, 0o600)).To(Succeed())
+
+			return path
+		}
+
+		BeforeEach(func() {
+			x86, err = LookupArch("x86_64")
+			Expect(err).ToNot(HaveOccurred())
+
+			tmpDir, err = os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, tmpDir)
+		})
+
+		It("Wraps raw blobs in the kernel microcode layout", func() {
+			intel := make([]byte, 64)
+			binary.LittleEndian.PutUint32(intel[0:], 1)
+			binary.LittleEndian.PutUint32(intel[20:], 1)
+			amd := []byte("DMA\x00amd microcode")
+
+			ucode, err := readMicrocode(x86, []string{writeFile("intel-1", intel), writeFile("amd", amd), writeFile("intel-2", intel)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(initrd.IsCPIO(ucode)).To(BeTrue())
+
+			// both Intel blobs end up in a single file, after its name and padding
+			intelName := "kernel/x86/microcode/GenuineIntel.bin\x00"
+			intelEntry := bytes.Index(ucode, []byte(intelName))
+			Expect(intelEntry).To(BeNumerically(">", 0))
+			intelData := int(alignUp(uint64(intelEntry+len(intelName)), 4))
+			Expect(ucode[intelData : intelData+2*len(intel)]).To(Equal(append(intel, intel...)))
+			// filesize field of the cpio header
+			Expect(string(ucode[intelEntry-110+54 : intelEntry-110+62])).To(Equal("00000080"))
+
+			Expect(bytes.Contains(ucode, []byte("kernel/x86/microcode/AuthenticAMD.bin\x00"))).To(BeTrue())
+			Expect(bytes.Contains(ucode, amd)).To(BeTrue())
+		})
+
+		It("Keeps cpio archives as they are", func() {
+			archive := []byte("070701 archive")
+
+			ucode, err := readMicrocode(x86, []string{writeFile("ucode.cpio", archive)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ucode).To(Equal(append(archive, 0, 0)))
+		})
+
+		It("Rejects what is not microcode", func() {
+			_, err := readMicrocode(x86, []string{writeFile("initrd", []byte("not microcode"))})
+			Expect(err).To(MatchError(ContainSubstring("neither a cpio archive nor an Intel or AMD microcode blob")))
+
+			arm, err := LookupArch("aarch64")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = readMicrocode(arm, []string{writeFile("amd", []byte("DMA\x00amd microcode"))})
+			Expect(err).To(MatchError(ContainSubstring("cannot be loaded on aarch64")))
+		})
+
+		It("Measures the microcode right after the initrd", func() {
+			Expect(constants.OrderedSections()).To(ContainElements(constants.Initrd, constants.UCode))
+			Expect(slices.Index(constants.OrderedSections(), constants.UCode)).To(Equal(slices.Index(constants.OrderedSections(), constants.Initrd) + 1))
+		})
+	})
+
+	Describe("Automatically selected devicetrees", func() {
+		const chid = "12345678-1234-5678-9abc-def012345678"
+
+		It("Reads the root compatible of a devicetree", func() {
+			compatible, err := dtbCompatible(newTestDTB("acme,board-v2\x00acme,board"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(compatible).To(Equal([]string{"acme,board-v2", "acme,board"}))
+		})
+
+		It("Encodes the .hwids section", func() {
+			data, err := encodeHWIDs([]HWID{{Name: "Board", Compatible: "acme,board", CHIDs: []string{chid}}})
+			Expect(err).ToNot(HaveOccurred())
+
+			expected := []byte{0x1c, 0x00, 0x00, 0x10}
+			expected = append(expected, 0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x78, 0x56, 0x9a, 0xbc, 0xde, 0xf0, 0x12, 0x34, 0x56, 0x78)
+			expected = append(expected, 56, 0, 0, 0, 62, 0, 0, 0)
+			expected = append(expected, make([]byte, 28)...)
+			expected = append(expected, "Board\x00acme,board\x00"...)
+			Expect(data).To(Equal(expected))
+		})
+
+		It("Loads hwids description files", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			Expect(os.WriteFile(filepath.Join(tmpDir, "board.json"), []byte(`{"type": "devicetree", "name": "Board", "compatible": "acme,board", "hwids": ["`+chid+`"]}`), 0o600)).To(Succeed())
+			hwids, err := LoadHWIDs(tmpDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hwids).To(Equal([]HWID{{Type: "devicetree", Name: "Board", Compatible: "acme,board", CHIDs: []string{chid}}}))
+
+			Expect(os.WriteFile(filepath.Join(tmpDir, "fw.json"), []byte(`{"type": "uefi-fw", "name": "Board", "fwid": "x", "hwids": ["`+chid+`"]}`), 0o600)).To(Succeed())
+			_, err = LoadHWIDs(tmpDir)
+			Expect(err).To(MatchError(ContainSubstring("unsupported hwid type")))
+		})
+
+		It("Adds the devicetrees in order and signs a policy for each", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			var paths []string
+			for _, compatible := range []string{"acme,board", "acme,other"} {
+				path := filepath.Join(tmpDir, compatible+".dtb")
+				Expect(os.WriteFile(path, newTestDTB(compatible), 0o600)).To(Succeed())
+				paths = append(paths, path)
+			}
+
+			signer, err := pesign.NewPCRSigner("../measure/pcr/testdata/private.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{
+				DevicetreeAutoPaths: paths,
+				HWIDs:               []HWID{{Name: "Board", Compatible: "acme,board", CHIDs: []string{chid}}},
+				PCRSigner:           signer,
+				Phases:              types.OrderedPhases(),
+			}
+			Expect(builder.generateDTBAuto()).To(Succeed())
+			Expect(builder.generateHWIDs()).To(Succeed())
+			Expect(builder.sections).To(HaveLen(3))
+			Expect(builder.sections[0].Data).To(Equal(newTestDTB("acme,board")))
+			Expect(builder.sections[1].Data).To(Equal(newTestDTB("acme,other")))
+			Expect(builder.sections[2].Name).To(Equal(constants.HWIDs))
+
+			sectionsContent, err := utils.SectionsContent(builder.sections)
+			Expect(err).ToNot(HaveOccurred())
+			pcrSig, err := builder.signPCR(sectionsContent)
+			Expect(err).ToNot(HaveOccurred())
+
+			var pcrData types.PCRData
+			Expect(json.Unmarshal(pcrSig, &pcrData)).To(Succeed())
+			// no match and each of the two devicetrees, for each phase
+			Expect(pcrData.SHA256).To(HaveLen(3 * len(types.OrderedPhases())))
+		})
+
+		It("Rejects hwids for devicetrees which are not there", func() {
+			builder := &Builder{HWIDs: []HWID{{Name: "Board", Compatible: "acme,board", CHIDs: []string{chid}}}}
+			Expect(builder.generateHWIDs()).To(MatchError(ContainSubstring("none of the automatically selected devicetrees")))
+		})
+	})
+
+	Describe("PCR policies", func() {
+		secureBoot := strings.Repeat("07", 32)
+
+		It("Parses PCR values", func() {
+			value, err := ParsePCRValue("7:sha256=" + secureBoot)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(value.PCR).To(Equal(7))
+			Expect(value.Alg).To(Equal(tpm2.TPMAlgSHA256))
+			Expect(value.Value).To(Equal(bytes.Repeat([]byte{7}, 32)))
+
+			for spec, message := range map[string]string{
+				"7=" + secureBoot:         "expected PCR:BANK=HEX",
+				"24:sha256=" + secureBoot: "expected 0 to 23",
+				"7:md5=" + secureBoot:     "invalid PCR bank",
+				"7:sha256=xyz":            "invalid value of PCR 7",
+				"7:sha1=" + secureBoot:    "expected 20 for the sha1 bank",
+			} {
+				_, err = ParsePCRValue(spec)
+				Expect(err).To(MatchError(ContainSubstring(message)), spec)
+			}
+		})
+
+		DescribeTable("Rejects inconsistent PCRs",
+			func(pcrs []int, specs []string, message string) {
+				builder := &Builder{PCRs: pcrs}
+				for _, spec := range specs {
+					value, err := ParsePCRValue(spec)
+					Expect(err).ToNot(HaveOccurred())
+					builder.PCRValues = append(builder.PCRValues, value)
+				}
+
+				_, err := builder.policyPCRValues()
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("without the UKI PCR", []int{7}, []string{"7:sha256=" + secureBoot}, "have to include PCR 11"),
+			Entry("without a value", []int{7, 11}, nil, "no value is given for PCR 7"),
+			Entry("with a value for the UKI PCR", []int{7, 11}, []string{"7:sha256=" + secureBoot, "11:sha256=" + secureBoot}, "not one of the other PCRs"),
+			Entry("with a value twice", []int{7, 11}, []string{"7:sha256=" + secureBoot, "7:sha256=" + secureBoot}, "given twice for the same bank"),
+			Entry("with values without PCRs", nil, []string{"7:sha256=" + secureBoot}, "without the PCRs of the policy"),
+		)
+
+		It("Signs the banks the PCR values are given for", func() {
+			signer, err := pesign.NewPCRSigner("../measure/pcr/testdata/private.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			value, err := ParsePCRValue("7:sha256=" + secureBoot)
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{PCRSigner: signer, Phases: types.OrderedPhases(), PCRs: []int{11, 7}, PCRValues: []types.PCRValue{value}}
+
+			pcrSig, err := builder.signPCR(measure.SectionsContent{constants.CMDLine: []byte("console=ttyS0")})
+			Expect(err).ToNot(HaveOccurred())
+
+			var pcrData types.PCRData
+			Expect(json.Unmarshal(pcrSig, &pcrData)).To(Succeed())
+			Expect(pcrData.SHA1).To(BeEmpty())
+			Expect(pcrData.SHA384).To(BeEmpty())
+			Expect(pcrData.SHA256).To(HaveLen(len(types.OrderedPhases())))
+
+			for _, bank := range pcrData.SHA256 {
+				Expect(bank.PCRs).To(Equal([]int{7, 11}))
+			}
+		})
+	})
+
+	Describe("Profiles", func() {
+		It("Loads profile description files", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			path := filepath.Join(tmpDir, "recovery.json")
+			Expect(os.WriteFile(path, []byte(`{"id": "recovery", "title": "Recovery", "cmdlineAppend": "kairos.recovery", "initrds": ["recovery.cpio", "/abs.cpio"]}`), 0o600)).To(Succeed())
+
+			profile, err := LoadProfile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(profile).To(Equal(Profile{
+				ID:            "recovery",
+				Title:         "Recovery",
+				CmdlineAppend: "kairos.recovery",
+				InitrdPaths:   []string{filepath.Join(tmpDir, "recovery.cpio"), "/abs.cpio"},
+			}))
+
+			Expect(os.WriteFile(path, []byte(`{"id": "recovery", "initrd": "recovery.cpio"}`), 0o600)).To(Succeed())
+			_, err = LoadProfile(path)
+			Expect(err).To(MatchError(ContainSubstring("unknown field")))
+		})
+
+		It("Writes the .profile section", func() {
+			profile := Profile{ID: "reset", Title: "Reset Kairos", Fields: map[string]string{"VERSION": "1", "ARCHITECTURE": "x86-64"}}
+			Expect(profile.validate()).To(Succeed())
+			Expect(string(profile.section())).To(Equal("ID=reset\nTITLE=\"Reset Kairos\"\nARCHITECTURE=x86-64\nVERSION=1\n"))
+
+			Expect(Profile{ID: "Reset"}.validate()).To(MatchError(ContainSubstring("invalid profile ID")))
+			Expect(Profile{ID: "reset", Fields: map[string]string{"TITLE": "x"}}.validate()).To(MatchError(ContainSubstring("invalid field")))
+		})
+
+		It("Overrides sections and signs a policy for each profile", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			recoveryInitrd := filepath.Join(tmpDir, "recovery.cpio")
+			Expect(os.WriteFile(recoveryInitrd, []byte("recovery"), 0o600)).To(Succeed())
+
+			signer, err := pesign.NewPCRSigner("../measure/pcr/testdata/private.pem")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{
+				Cmdline: "console=ttyS0",
+				Profiles: []Profile{
+					{ID: "default", Title: "Kairos"},
+					{ID: "recovery", Title: "Recovery", CmdlineAppend: "kairos.recovery", InitrdPaths: []string{recoveryInitrd}},
+				},
+				PCRSigner:  signer,
+				Phases:     types.OrderedPhases(),
+				initrdData: []byte("initrd"),
+			}
+			Expect(builder.generateCmdline()).To(Succeed())
+			Expect(builder.generateInitrd()).To(Succeed())
+			Expect(builder.generateProfiles()).To(Succeed())
+			Expect(builder.generatePCRSig()).To(Succeed())
+
+			var names []constants.Section
+			for _, section := range builder.sections {
+				names = append(names, section.Name)
+			}
+
+			Expect(names).To(Equal([]constants.Section{
+				constants.CMDLine, constants.Initrd,
+				constants.Profile, constants.PCRSig,
+				constants.Profile, constants.CMDLine, constants.Initrd, constants.PCRSig,
+			}))
+			Expect(string(builder.sections[5].Data)).To(Equal("console=ttyS0 kairos.recovery"))
+			Expect(string(builder.sections[6].Data)).To(Equal("recovery"))
+			Expect(builder.sections[3].Data).ToNot(Equal(builder.sections[7].Data))
+		})
+
+		It("Turns extra cmdlines into profiles", func() {
+			builder := &Builder{ExtraCmdlines: []string{"kairos.reset"}}
+			profiles, err := builder.profiles()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(profiles).To(Equal([]Profile{{ID: "profile-0"}, {ID: "profile-1", Cmdline: "kairos.reset"}}))
+
+			builder.Profiles = []Profile{{ID: "default"}}
+			_, err = builder.profiles()
+			Expect(err).To(MatchError(ContainSubstring("cannot be given together")))
+		})
+
+		It("Rejects profiles given twice", func() {
+			builder := &Builder{Profiles: []Profile{{ID: "default"}, {ID: "default"}}}
+			Expect(builder.generateProfiles()).To(MatchError("profile default is given twice"))
+		})
+	})
+
+	Describe("StubInfo", func() {
+		It("Detects the version from .sdmagic", func() {
+			info, err := GetStubInfo("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Name).To(Equal("systemd-boot"))
+			Expect(info.Version).To(Equal("254.10-1.fc39"))
+			Expect(info.Major).To(Equal(254))
+			Expect(info.Supports(constants.Profile)).To(BeFalse())
+			Expect(info.Supports(constants.CMDLine)).To(BeTrue())
+		})
+
+		It("Refuses sections the stub does not support", func() {
+			info, err := GetStubInfo("testdata/sd-boot.efi")
+			Expect(err).ToNot(HaveOccurred())
+
+			builder := &Builder{stub: info, sections: []types.UkiSection{
+				{Name: constants.CMDLine, Append: true},
+				{Name: constants.Profile, Append: true},
+			}}
+			Expect(builder.checkStubSupport()).To(MatchError(ContainSubstring("systemd 257 or newer")))
+		})
+
+		It("Assumes everything is supported by unknown stubs", func() {
+			tmpDir, err := os.MkdirTemp("", "uki")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+
+			stub := filepath.Join(tmpDir, "stub")
+			Expect(os.WriteFile(stub, newTestPE(pe.IMAGE_FILE_MACHINE_AMD64), 0o600)).To(Succeed())
+
+			info, err := GetStubInfo(stub)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Major).To(BeZero())
+			Expect(info.Supports(constants.Profile)).To(BeTrue())
+		})
+	})
+})
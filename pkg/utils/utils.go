@@ -28,6 +28,25 @@ func SectionsData(sections []types.UkiSection) map[constants.Section]string {
 	return data
 }
 
+// SectionsContent is like SectionsData, but returns the contents of the measured sections
+// instead of their paths, so sections which only live in memory can be measured too.
+func SectionsContent(sections []types.UkiSection) (map[constants.Section][]byte, error) {
+	data := map[constants.Section][]byte{}
+	for _, s := range sections {
+		if s.Measure {
+			content, err := s.Content()
+			if err != nil {
+				return nil, err
+			}
+			data[s.Name] = content
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data, nil
+}
+
 // SignEFIExecutable signs an executable
 // go-uefi dropped this but they still all of the methods needed to sign an executable
 func SignEFIExecutable(key crypto.Signer, cert *x509.Certificate, file []byte) ([]byte, error) {